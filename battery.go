@@ -0,0 +1,129 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	"github.com/muka/go-bluetooth/bluez/profile/adapter"
+	"github.com/muka/go-bluetooth/bluez/profile/battery"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+type BatteryLevel struct {
+	Name       string
+	Address    string
+	Percentage int
+}
+
+// Battery levels of the connected devices by MAC address
+var Batteries = &BatteryLevels{levels: make(map[string]BatteryLevel, 0)}
+
+type BatteryLevels struct {
+	mu     sync.Mutex
+	levels map[string]BatteryLevel
+}
+
+func (b *BatteryLevels) Get(address string) (BatteryLevel, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	level, ok := b.levels[address]
+	return level, ok
+}
+
+// Returns all battery levels, sorted by address
+func (b *BatteryLevels) All() []BatteryLevel {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	levels := make([]BatteryLevel, 0, len(b.levels))
+	for _, level := range b.levels {
+		levels = append(levels, level)
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].Address < levels[j].Address })
+	return levels
+}
+
+// Replaces the levels of the devices of an adapter
+func (b *BatteryLevels) set(addresses map[string]bool, levels []BatteryLevel) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for address := range addresses {
+		delete(b.levels, address)
+	}
+	for _, level := range levels {
+		if old, ok := b.levels[level.Address]; !ok || old.Percentage != level.Percentage {
+			log.Infof("Battery level of %s (%s): %d%%", level.Name, level.Address, level.Percentage)
+		}
+		b.levels[level.Address] = level
+	}
+}
+
+// Reads org.bluez.Battery1.Percentage of the connected input devices of
+// an adapter. Devices without the Battery1 interface are skipped.
+func ReadBatteryLevels(adapterId string) error {
+	a, err := adapter.GetAdapter(adapterId)
+	if err != nil {
+		return err
+	}
+	devices, err := a.GetDevices()
+	if err != nil {
+		return err
+	}
+
+	addresses := make(map[string]bool, len(devices))
+	levels := make([]BatteryLevel, 0)
+	for _, dev := range devices {
+		address, err := dev.GetAddress()
+		if err != nil {
+			continue
+		}
+		address = NormalizeMac(address)
+		addresses[address] = true
+		connected, _ := dev.GetConnected()
+		uuids, _ := dev.GetUUIDs()
+		if !connected || !isInputProfile(uuids) {
+			continue
+		}
+		name, err := dev.GetName()
+		if err != nil {
+			name = "?"
+		}
+
+		b, err := battery.NewBattery1(dev.Path())
+		if err != nil {
+			log.Debugf("No battery information for %s (%s): %s", name, address, err.Error())
+			continue
+		}
+		percentage, err := b.GetPercentage()
+		b.Close()
+		if err != nil {
+			log.Debugf("No battery information for %s (%s): %s", name, address, err.Error())
+			continue
+		}
+		levels = append(levels, BatteryLevel{Name: name, Address: address, Percentage: int(percentage)})
+	}
+	Batteries.set(addresses, levels)
+	return nil
+}
+
+// Polls the battery levels of connected devices every interval
+func PollBatteries(ctx context.Context, adapters []string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, adapterId := range adapters {
+			if err := ReadBatteryLevels(adapterId); err != nil {
+				log.Warnf("Unable to read battery levels on %s: %s", adapterId, err.Error())
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
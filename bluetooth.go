@@ -0,0 +1,106 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	"github.com/muka/go-bluetooth/bluez/profile/adapter"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+const (
+	HID_UUID  = "00001124-0000-1000-8000-00805f9b34fb" // Human Interface Device
+	HOGP_UUID = "00001812-0000-1000-8000-00805f9b34fb" // HID over GATT
+)
+
+func isInputProfile(uuids []string) bool {
+	for _, uuid := range uuids {
+		uuid = strings.ToLower(uuid)
+		if uuid == HID_UUID || uuid == HOGP_UUID {
+			return true
+		}
+	}
+	return false
+}
+
+// Calls Connect() on the paired and trusted input devices of an adapter
+// that are not connected. Returns the number of devices left unconnected.
+func ConnectKnownDevices(adapterId string) (int, error) {
+	a, err := adapter.GetAdapter(adapterId)
+	if err != nil {
+		return 0, err
+	}
+	devices, err := a.GetDevices()
+	if err != nil {
+		return 0, err
+	}
+
+	unconnected := 0
+	for _, dev := range devices {
+		paired, _ := dev.GetPaired()
+		trusted, _ := dev.GetTrusted()
+		uuids, _ := dev.GetUUIDs()
+		connected, _ := dev.GetConnected()
+		if !paired || !trusted || connected || !isInputProfile(uuids) {
+			continue
+		}
+		name, err := dev.GetName()
+		if err != nil {
+			name = "?"
+		}
+		address, _ := dev.GetAddress()
+		log.Infof("Connecting to known device %s (%s) on %s...", name, address, adapterId)
+		if err := dev.Connect(); err != nil {
+			log.Debugf("Failed to connect to %s (%s): %s", name, address, err.Error())
+			unconnected++
+			continue
+		}
+		log.Infof("Connected to %s (%s)", name, address)
+	}
+	return unconnected, nil
+}
+
+// ConnectKnown connects known input devices on startup and whenever
+// triggered (after a disconnect), retrying every interval until all are
+// connected or maxAttempts is reached (0 retries forever).
+func ConnectKnown(ctx context.Context, adapters []string, interval time.Duration, maxAttempts int, trigger <-chan struct{}) {
+	pending := true
+	attempts := 0
+	for {
+		if pending {
+			attempts++
+			unconnected := 0
+			for _, adapterId := range adapters {
+				n, err := ConnectKnownDevices(adapterId)
+				if err != nil {
+					log.Warnf("Unable to connect known devices on %s: %s", adapterId, err.Error())
+					n = 1
+				}
+				unconnected += n
+			}
+			if unconnected == 0 {
+				pending = false
+			} else if maxAttempts > 0 && attempts >= maxAttempts {
+				log.Warnf("Giving up connecting known devices after %d attempts", attempts)
+				pending = false
+			}
+		}
+
+		var retry <-chan time.Time
+		if pending {
+			retry = time.After(interval)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-trigger:
+			pending = true
+			attempts = 0
+		case <-retry:
+		}
+	}
+}
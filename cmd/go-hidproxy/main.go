@@ -6,37 +6,327 @@ package main
 
 import (
 	hidproxy "github.com/rosmo/go-hidproxy"
+	"context"
 	"flag"
 	"fmt"
 	log "github.com/sirupsen/logrus"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+func splitList(s string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func splitMap(s string) map[string]string {
+	m := make(map[string]string, 0)
+	for _, item := range splitList(s) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) == 2 {
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		} else {
+			m[strings.TrimSpace(kv[0])] = ""
+		}
+	}
+	return m
+}
+
 func main() {
-	logLevelPtr := flag.String("loglevel", "info", "log level (panic, fatal, error, warn, info, debug, trace)")
-	setupHid := flag.Bool("setuphid", true, "setup HID files on startup")
-	setupMouse := flag.Bool("mouse", true, "setup mouse(s)")
-	setupKeyboard := flag.Bool("keyboard", true, "setup keyboard(s)")
-	monitorUdev := flag.Bool("monitor-udev", true, "monitor udev & BlueZ events for disconnects")
-	adapterId := flag.String("bluez-adapter", "hci0", "BlueZ adapter (default hci0)")
-	kbdRepeat := flag.Int("kbdrepeat", 62, "set keyboard repeat rate (default 62)")
-	kbdDelay := flag.Int("kbddelay", 300, "set keyboard repeat delay in ms (default 300)")
+	defaults := hidproxy.DefaultConfig()
+	configFile := flag.String("config", "", "load configuration from a YAML/JSON file (flags override file values)")
+	logLevelPtr := flag.String("loglevel", defaults.LogLevel.String(), "log level (panic, fatal, error, warn, info, debug, trace)")
+	logFile := flag.String("log-file", defaults.LogFile, "log to a file instead of stderr")
+	logMaxSizeMB := flag.Int("log-max-size-mb", defaults.LogMaxSizeMB, "rotate the log file after this many megabytes (0 to never rotate)")
+	logEvents := flag.Bool("log-events", defaults.LogEvents, "log every forwarded event and the resulting HID report as JSON")
+	record := flag.String("record", defaults.Record, "record the HID reports sent to the gadget to a file")
+	replay := flag.String("replay", "", "replay the HID reports recorded in a file to the gadget, then exit")
+	measureLatency := flag.Bool("measure-latency", defaults.MeasureLatency, "measure the latency from input events to HID reports")
+	setupHid := flag.Bool("setuphid", defaults.SetupHid, "setup HID files on startup")
+	setupMouse := flag.Bool("mouse", defaults.SetupMouse, "setup mouse(s)")
+	setupKeyboard := flag.Bool("keyboard", defaults.SetupKeyboard, "setup keyboard(s)")
+	setupTablet := flag.Bool("tablet", defaults.SetupTablet, "setup absolute pointer device for tablets and touch devices")
+	setupGamepad := flag.Bool("gamepad", defaults.SetupGamepad, "setup gamepad device for gamepads and joysticks")
+	setupDigitizer := flag.Bool("digitizer", defaults.SetupDigitizer, "setup multitouch digitizer device for touchpads and touch screens")
+	maxContacts := flag.Int("max-contacts", defaults.MaxContacts, "number of contacts reported by the digitizer (1-10)")
+	setupConsumer := flag.Bool("consumer", defaults.SetupConsumer, "setup consumer control (media keys) device")
+	keyboardNKRO := flag.Bool("nkro", defaults.KeyboardNKRO, "use N-key rollover keyboard reports (not boot protocol compatible)")
+	forceBootProtocol := flag.Bool("force-boot-protocol", defaults.ForceBootProtocol, "always send boot protocol keyboard reports, for BIOS setup screens (disables -nkro)")
+	mouseHiRes := flag.Bool("mouse-hires", defaults.MouseHiRes, "use high resolution and horizontal scrolling mouse reports")
+	mouseScale := flag.Float64("mouse-scale", defaults.MouseScale, "scale mouse movement by this factor")
+	mouseAccelThreshold := flag.Int("mouse-accel-threshold", defaults.MouseAccelThreshold, "mouse movement above this many units per event is accelerated")
+	mouseAccelFactor := flag.Float64("mouse-accel-factor", defaults.MouseAccelFactor, "mouse acceleration factor (default 0, disabled)")
+	invertScroll := flag.Bool("invert-scroll", defaults.InvertScroll, "reverse the vertical scroll direction")
+	invertHScroll := flag.Bool("invert-hscroll", defaults.InvertHScroll, "reverse the horizontal scroll direction")
+	mouseExtraButtons := flag.Bool("mouse-extra-buttons", defaults.MouseExtraButtons, "forward back/forward thumb buttons (BTN_SIDE/BTN_EXTRA, BTN_BACK/BTN_FORWARD) as mouse buttons 4 and 5")
+	mouseCoalesceMs := flag.Int("mouse-coalesce-ms", defaults.MouseCoalesceMs, "combine mouse motion into at most one report per this many ms (default 0, disabled)")
+	compositeGadget := flag.Bool("composite", defaults.CompositeGadget, "use a single composite HID gadget with report IDs for all devices")
+	vendorId := flag.String("vendor-id", defaults.VendorId, "USB vendor ID of the gadget (0xXXXX)")
+	productId := flag.String("product-id", defaults.ProductId, "USB product ID of the gadget (0xXXXX)")
+	manufacturer := flag.String("manufacturer", defaults.Manufacturer, "USB manufacturer string of the gadget")
+	product := flag.String("product", defaults.Product, "USB product string of the gadget")
+	serialNumber := flag.String("serial-number", defaults.SerialNumber, "USB serial number of the gadget")
+	reuseGadget := flag.Bool("reuse-gadget", defaults.ReuseGadget, "reuse an existing USB gadget if its descriptors match instead of recreating it")
+	udcName := flag.String("udc-name", defaults.UdcName, "USB device controller to bind the gadget to (default the only one)")
+	udcWaitTimeout := flag.Int("udc-wait-timeout", defaults.UdcWaitTimeout, "seconds to wait for a USB device controller at startup")
+	keyboardDescriptor := flag.String("keyboard-descriptor", defaults.KeyboardDescriptor, "file with a raw HID report descriptor replacing the keyboard one")
+	mouseDescriptor := flag.String("mouse-descriptor", defaults.MouseDescriptor, "file with a raw HID report descriptor replacing the mouse one")
+	outputMode := flag.String("output-mode", defaults.OutputMode, "where to send HID reports: local gadget files or net to a receiver")
+	remoteAddr := flag.String("remote-addr", defaults.RemoteAddr, "address of the receiver in net output mode, eg. otherpi:7410")
+	receiveAddr := flag.String("receive-addr", defaults.ReceiveAddr, "run as a receiver, writing reports from a proxy in net output mode to the local gadget")
+	receiveAllow := flag.String("receive-allow", "", "comma-separated list of addresses or networks (CIDR) allowed to send reports to the receiver (default loopback only)")
+	netProtocol := flag.String("net-protocol", defaults.NetProtocol, "protocol for net output mode and the receiver (tcp or udp)")
+	monitorUdev := flag.Bool("monitor-udev", defaults.MonitorUdev, "monitor udev & BlueZ events for disconnects")
+	grabDevices := flag.Bool("grab-devices", defaults.GrabDevices, "grab input devices for exclusive access, so input doesn't also go to the local system")
+	includeSystemControl := flag.Bool("include-system-control", defaults.IncludeSystemControl, "also open device nodes with only system control keys (power, sleep)")
+	includeSensors := flag.Bool("include-sensors", defaults.IncludeSensors, "also open motion sensor device nodes")
+	adapterId := flag.String("bluez-adapter", defaults.AdapterId, "BlueZ adapter (default hci0)")
+	adapterIds := flag.String("bluez-adapters", "", "comma-separated list of BlueZ adapters (overrides -bluez-adapter)")
+	connectKnown := flag.Bool("connect-known", defaults.ConnectKnown, "connect paired and trusted input devices on startup and after disconnects")
+	connectRetryInterval := flag.Int("connect-retry-interval", defaults.ConnectRetryInterval, "seconds between attempts to connect known devices")
+	connectMaxAttempts := flag.Int("connect-max-attempts", defaults.ConnectMaxAttempts, "attempts to connect known devices before giving up (0 for no limit)")
+	pair := flag.Bool("pair", false, "make the Bluetooth adapters discoverable and pair, trust and connect input devices, then exit")
+	pairingTimeout := flag.Int("pairing-timeout", defaults.PairingTimeout, "seconds the adapters stay discoverable and pairable when pairing")
+	batteryInterval := flag.Int("battery-interval", defaults.BatteryInterval, "seconds between reading battery levels of connected devices (default disabled)")
+	writeRetries := flag.Int("write-retries", defaults.WriteRetries, "times to reopen a HID gadget file and resend a report after a write error")
+	eventQueueSize := flag.Int("event-queue-size", defaults.EventQueueSize, "reports buffered for each HID gadget file, the oldest mouse motion is dropped when full (default 100)")
+	idleTimeout := flag.Int("idle-timeout", defaults.IdleTimeout, "seconds without input before the gadget is put to sleep (default disabled)")
+	idleUnbind := flag.Bool("idle-unbind", defaults.IdleUnbind, "unbind the gadget from the UDC when idle, instead of just closing the gadget files")
+	linkTimeout := flag.Int("link-timeout", defaults.LinkTimeout, "seconds without events from a device with keys or buttons held before they are released (default disabled)")
+	kbdRepeat := flag.Int("kbdrepeat", defaults.KbdRepeat, "set keyboard repeat rate, in ms between repeats (default 62)")
+	kbdDelay := flag.Int("kbddelay", defaults.KbdDelay, "set keyboard repeat delay in ms (default 300)")
+	softwareRepeat := flag.Bool("software-repeat", defaults.SoftwareRepeat, "repeat held keys in the proxy instead of setting the repeat of the keyboards (EVIOCSREP)")
+	debounceMs := flag.Int("debounce-ms", defaults.DebounceMs, "drop repeated presses of a key within this many ms, for chattering keys (default disabled)")
+	syncLeds := flag.Bool("sync-leds", defaults.SyncLeds, "sync keyboard LEDs (CapsLock etc.) from host to keyboard(s)")
+	allowDevices := flag.String("allow-devices", "", "comma-separated list of device MAC addresses to proxy (default all)")
+	mouseButtonMap := flag.String("mouse-button-map", "", "comma-separated list of mouse button remaps, eg. BTN_LEFT=BTN_RIGHT,BTN_RIGHT=BTN_LEFT (empty target disables a button)")
+	mouseChords := flag.String("mouse-chords", "", "comma-separated list of mouse button chords, eg. BTN_LEFT+BTN_RIGHT=BTN_MIDDLE")
+	mouseChordMs := flag.Int("mouse-chord-ms", defaults.MouseChordMs, "how soon the buttons of a mouse chord need to be pressed after each other in ms")
+	layout := flag.String("layout", defaults.Layout, "translate keys from a QWERTY keyboard to this layout (qwerty, dvorak, colemak)")
+	keyRemap := flag.String("key-remap", "", "comma-separated list of key remaps, eg. KEY_CAPSLOCK=KEY_LEFTCTRL (empty target disables a key)")
+	matchDevices := flag.String("match-devices", "", "comma-separated list of device name or /dev/input/by-id patterns to proxy, eg. usb-*-event-kbd (combined with allow-devices)")
+	toggleHotkey := flag.String("toggle-hotkey", "", "key combination pausing and resuming forwarding, eg. KEY_LEFTCTRL+KEY_LEFTALT+KEY_PAUSE")
+	macroDelayMs := flag.Int("macro-delay-ms", defaults.MacroDelayMs, "delay in ms between the steps of macros (macros are set in the config file)")
+	denyDevices := flag.String("deny-devices", "", "comma-separated list of device MAC addresses to ignore")
+	controlSocket := flag.String("control-socket", "", "listen for commands (status, list-devices, pause, resume, reload) on this Unix socket")
+	metricsAddr := flag.String("metrics-addr", defaults.MetricsAddr, "serve Prometheus metrics on this address, eg. :9101 (default disabled)")
 	flag.Parse()
 
-	logLevel, err := log.ParseLevel(*logLevelPtr)
+	// Flags are applied on top of the config file, also when it is reloaded
+	loadConfig := func() (hidproxy.Config, error) {
+		config := defaults
+		if *configFile != "" {
+			var err error
+			config, err = hidproxy.LoadConfig(*configFile)
+			if err != nil {
+				return config, err
+			}
+		}
+
+		var flagErr error
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "loglevel":
+				config.LogLevel, flagErr = log.ParseLevel(*logLevelPtr)
+			case "log-file":
+				config.LogFile = *logFile
+			case "log-max-size-mb":
+				config.LogMaxSizeMB = *logMaxSizeMB
+			case "log-events":
+				config.LogEvents = *logEvents
+			case "record":
+				config.Record = *record
+			case "measure-latency":
+				config.MeasureLatency = *measureLatency
+			case "setuphid":
+				config.SetupHid = *setupHid
+			case "mouse":
+				config.SetupMouse = *setupMouse
+			case "keyboard":
+				config.SetupKeyboard = *setupKeyboard
+			case "consumer":
+				config.SetupConsumer = *setupConsumer
+			case "tablet":
+				config.SetupTablet = *setupTablet
+			case "gamepad":
+				config.SetupGamepad = *setupGamepad
+			case "digitizer":
+				config.SetupDigitizer = *setupDigitizer
+			case "max-contacts":
+				config.MaxContacts = *maxContacts
+			case "nkro":
+				config.KeyboardNKRO = *keyboardNKRO
+			case "force-boot-protocol":
+				config.ForceBootProtocol = *forceBootProtocol
+			case "mouse-hires":
+				config.MouseHiRes = *mouseHiRes
+			case "mouse-scale":
+				config.MouseScale = *mouseScale
+			case "mouse-accel-threshold":
+				config.MouseAccelThreshold = *mouseAccelThreshold
+			case "mouse-accel-factor":
+				config.MouseAccelFactor = *mouseAccelFactor
+			case "invert-scroll":
+				config.InvertScroll = *invertScroll
+			case "invert-hscroll":
+				config.InvertHScroll = *invertHScroll
+			case "mouse-coalesce-ms":
+				config.MouseCoalesceMs = *mouseCoalesceMs
+			case "mouse-extra-buttons":
+				config.MouseExtraButtons = *mouseExtraButtons
+			case "composite":
+				config.CompositeGadget = *compositeGadget
+			case "vendor-id":
+				config.VendorId = *vendorId
+			case "product-id":
+				config.ProductId = *productId
+			case "manufacturer":
+				config.Manufacturer = *manufacturer
+			case "product":
+				config.Product = *product
+			case "serial-number":
+				config.SerialNumber = *serialNumber
+			case "reuse-gadget":
+				config.ReuseGadget = *reuseGadget
+			case "udc-name":
+				config.UdcName = *udcName
+			case "udc-wait-timeout":
+				config.UdcWaitTimeout = *udcWaitTimeout
+			case "keyboard-descriptor":
+				config.KeyboardDescriptor = *keyboardDescriptor
+			case "mouse-descriptor":
+				config.MouseDescriptor = *mouseDescriptor
+			case "output-mode":
+				config.OutputMode = *outputMode
+			case "remote-addr":
+				config.RemoteAddr = *remoteAddr
+			case "receive-addr":
+				config.ReceiveAddr = *receiveAddr
+			case "receive-allow":
+				config.ReceiveAllow = splitList(*receiveAllow)
+			case "net-protocol":
+				config.NetProtocol = *netProtocol
+			case "monitor-udev":
+				config.MonitorUdev = *monitorUdev
+			case "grab-devices":
+				config.GrabDevices = *grabDevices
+			case "include-system-control":
+				config.IncludeSystemControl = *includeSystemControl
+			case "include-sensors":
+				config.IncludeSensors = *includeSensors
+			case "bluez-adapter":
+				config.AdapterId = *adapterId
+			case "bluez-adapters":
+				config.AdapterIds = splitList(*adapterIds)
+			case "connect-known":
+				config.ConnectKnown = *connectKnown
+			case "connect-retry-interval":
+				config.ConnectRetryInterval = *connectRetryInterval
+			case "connect-max-attempts":
+				config.ConnectMaxAttempts = *connectMaxAttempts
+			case "pairing-timeout":
+				config.PairingTimeout = *pairingTimeout
+			case "battery-interval":
+				config.BatteryInterval = *batteryInterval
+			case "write-retries":
+				config.WriteRetries = *writeRetries
+			case "event-queue-size":
+				config.EventQueueSize = *eventQueueSize
+			case "link-timeout":
+				config.LinkTimeout = *linkTimeout
+			case "idle-timeout":
+				config.IdleTimeout = *idleTimeout
+			case "idle-unbind":
+				config.IdleUnbind = *idleUnbind
+			case "kbdrepeat":
+				config.KbdRepeat = *kbdRepeat
+			case "kbddelay":
+				config.KbdDelay = *kbdDelay
+			case "software-repeat":
+				config.SoftwareRepeat = *softwareRepeat
+			case "debounce-ms":
+				config.DebounceMs = *debounceMs
+			case "sync-leds":
+				config.SyncLeds = *syncLeds
+			case "allow-devices":
+				config.AllowDevices = splitList(*allowDevices)
+			case "deny-devices":
+				config.DenyDevices = splitList(*denyDevices)
+			case "match-devices":
+				config.MatchDevices = splitList(*matchDevices)
+			case "control-socket":
+				config.ControlSocket = *controlSocket
+			case "metrics-addr":
+				config.MetricsAddr = *metricsAddr
+			case "mouse-button-map":
+				config.MouseButtonMap = splitMap(*mouseButtonMap)
+			case "mouse-chords":
+				config.MouseChords = splitMap(*mouseChords)
+			case "mouse-chord-ms":
+				config.MouseChordMs = *mouseChordMs
+			case "layout":
+				config.Layout = *layout
+			case "toggle-hotkey":
+				config.ToggleHotkey = *toggleHotkey
+			case "macro-delay-ms":
+				config.MacroDelayMs = *macroDelayMs
+			case "key-remap":
+				config.KeyRemap = splitMap(*keyRemap)
+			}
+		})
+		return config, flagErr
+	}
+
+	config, err := loadConfig()
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("Set log level: %v\n", logLevel)
-	log.SetLevel(logLevel)
-
-	hidproxy.Start(hidproxy.Config{
-		SetupHid: *setupHid,
-		SetupMouse: *setupMouse,
-		SetupKeyboard: *setupKeyboard,
-		MonitorUdev: *monitorUdev,
-		AdapterId: *adapterId,
-		KbdRepeat: *kbdRepeat,
-		KbdDelay: *kbdDelay,
-		LogLevel: logLevel,
-	})
+
+	fmt.Printf("Set log level: %v\n", config.LogLevel)
+	log.SetLevel(config.LogLevel)
+	if config.LogFile != "" {
+		if err := hidproxy.SetupLogFile(config.LogFile, config.LogMaxSizeMB); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *pair {
+		window := time.Duration(config.PairingTimeout) * time.Second
+		if err := hidproxy.PairDevices(context.Background(), config.Adapters(), window); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *replay != "" {
+		if err := hidproxy.Replay(context.Background(), config, *replay); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if config.ReceiveAddr != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		if err := hidproxy.RunReceiver(ctx, config, config.NetProtocol, config.ReceiveAddr); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	proxy, err := hidproxy.New(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxy.SetConfigLoader(loadConfig)
+	if err := proxy.RunUntilSignal(); err != nil {
+		log.Fatal(err)
+	}
 }
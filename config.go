@@ -0,0 +1,233 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func DefaultConfig() Config {
+	return Config{
+		SetupHid:             true,
+		SetupMouse:           true,
+		SetupKeyboard:        true,
+		SetupConsumer:        true,
+		MaxContacts:          5,
+		KeyboardNKRO:         false,
+		VendorId:             "0x1d6b",
+		ProductId:            "0x0104",
+		Manufacturer:         "Raspberry Pi",
+		Product:              "pizero keyboard Device",
+		SerialNumber:         "fedcba9876543210",
+		ReuseGadget:          true,
+		UdcWaitTimeout:       30,
+		MouseScale:           1.0,
+		OutputMode:           OUTPUT_LOCAL,
+		NetProtocol:          "tcp",
+		MonitorUdev:          true,
+		GrabDevices:          true,
+		AdapterId:            "hci0",
+		KbdRepeat:            62,
+		KbdDelay:             300,
+		Layout:               "qwerty",
+		MacroDelayMs:         10,
+		MouseChordMs:         50,
+		MouseExtraButtons:    true,
+		SyncLeds:             true,
+		WriteRetries:         5,
+		EventQueueSize:       100,
+		ConnectRetryInterval: 10,
+		ConnectMaxAttempts:   30,
+		PairingTimeout:       120,
+		LogLevel:             log.InfoLevel,
+		LogMaxSizeMB:         10,
+	}
+}
+
+// Adapters returns the BlueZ adapters to monitor. AdapterIds takes
+// precedence over the single AdapterId when set.
+func (c Config) Adapters() []string {
+	if len(c.AdapterIds) > 0 {
+		return c.AdapterIds
+	}
+	if c.AdapterId != "" {
+		return []string{c.AdapterId}
+	}
+	return []string{}
+}
+
+// Repeat returns the repeat rate and delay of a keyboard, matching the
+// overrides by MAC address first and then by device name.
+func (c Config) Repeat(name string, mac string) (uint, uint) {
+	rate, delay := c.KbdRepeat, c.KbdDelay
+	override, ok := RepeatConfig{}, false
+	for key, value := range c.KbdRepeatOverrides {
+		if mac != "" && NormalizeMac(key) == mac {
+			override, ok = value, true
+			break
+		}
+		if key == name {
+			override, ok = value, true
+		}
+	}
+	if ok {
+		if override.Rate != 0 {
+			rate = override.Rate
+		}
+		if override.Delay != 0 {
+			delay = override.Delay
+		}
+	}
+	return uint(rate), uint(delay)
+}
+
+// Roles an input device can be proxied as
+var DeviceRoleNames = []string{"keyboard", "mouse", "tablet", "gamepad", "digitizer"}
+
+// CheckDeviceRoles validates the roles in DeviceRoles
+func (c Config) CheckDeviceRoles() error {
+	for device, roles := range c.DeviceRoles {
+		for _, role := range roles {
+			known := false
+			for _, name := range DeviceRoleNames {
+				known = known || strings.ToLower(role) == name
+			}
+			if !known {
+				return fmt.Errorf("unknown role for %s in device-roles: %s", device, role)
+			}
+		}
+	}
+	return nil
+}
+
+// AllowsRole returns true if a device may be proxied in a role, matching
+// DeviceRoles by MAC address first and then by device name. Devices
+// without an entry are proxied in all roles.
+func (c Config) AllowsRole(name string, mac string, role string) bool {
+	roles, ok := []string{}, false
+	for key, value := range c.DeviceRoles {
+		if mac != "" && NormalizeMac(key) == mac {
+			roles, ok = value, true
+			break
+		}
+		if key == name {
+			roles, ok = value, true
+		}
+	}
+	if !ok {
+		return true
+	}
+	for _, allowed := range roles {
+		if strings.ToLower(allowed) == role {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckGadgetIds validates the USB vendor and product IDs of the gadget,
+// which configfs expects as 0xXXXX.
+func (c Config) CheckGadgetIds() error {
+	for name, id := range map[string]string{"vendor": c.VendorId, "product": c.ProductId} {
+		if len(id) != 6 || !strings.HasPrefix(id, "0x") {
+			return fmt.Errorf("invalid USB %s ID %q, expected 0xXXXX", name, id)
+		}
+		if _, err := strconv.ParseUint(id[2:], 16, 16); err != nil {
+			return fmt.Errorf("invalid USB %s ID %q, expected 0xXXXX", name, id)
+		}
+	}
+	return nil
+}
+
+// The kernel doesn't accept longer report descriptors
+const HID_MAX_DESCRIPTOR_SIZE = 4096
+
+// LoadDescriptor reads a raw HID report descriptor overriding a built-in one
+func LoadDescriptor(path string) ([]byte, error) {
+	desc, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report descriptor: %w", err)
+	}
+	if len(desc) == 0 {
+		return nil, fmt.Errorf("report descriptor %s is empty", path)
+	}
+	if len(desc) > HID_MAX_DESCRIPTOR_SIZE {
+		return nil, fmt.Errorf("report descriptor %s is %d bytes, at most %d are supported", path, len(desc), HID_MAX_DESCRIPTOR_SIZE)
+	}
+	return desc, nil
+}
+
+// CheckGadget validates the gadget IDs and descriptor overrides before
+// setting up the gadget.
+func (c Config) CheckGadget() error {
+	if err := c.CheckGadgetIds(); err != nil {
+		return err
+	}
+	if c.SetupDigitizer {
+		if err := CheckMaxContacts(c.MaxContacts); err != nil {
+			return err
+		}
+	}
+	for _, path := range []string{c.KeyboardDescriptor, c.MouseDescriptor} {
+		if path == "" {
+			continue
+		}
+		if _, err := LoadDescriptor(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keeps the gadget usable by hosts that only speak the boot protocol (eg.
+// BIOS setup screens): the keyboard always sends 8 byte boot reports from
+// its own boot interface, with the built-in boot descriptor, so NKRO, the
+// composite gadget and a keyboard descriptor override can't be used. This
+// only changes the gadget configuration: f_hid answers SET_PROTOCOL from
+// the host itself, so the proxy never sees which protocol is selected.
+func applyBootProtocol(config Config) (Config, error) {
+	if !config.ForceBootProtocol {
+		return config, nil
+	}
+	if config.CompositeGadget {
+		return config, fmt.Errorf("force-boot-protocol can't be used with a composite gadget")
+	}
+	if config.KeyboardDescriptor != "" {
+		return config, fmt.Errorf("force-boot-protocol can't be used with keyboard-descriptor")
+	}
+	if config.KeyboardNKRO {
+		log.Warn("Boot protocol is forced, using boot keyboard reports instead of NKRO")
+		config.KeyboardNKRO = false
+	}
+	return config, nil
+}
+
+// LoadConfig reads a YAML (or JSON) configuration file. Keys use the same
+// names as the command-line flags and missing keys keep their defaults.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return config, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return config, nil
+}
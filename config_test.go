@@ -0,0 +1,33 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"testing"
+)
+
+func TestApplyBootProtocol(t *testing.T) {
+	config := DefaultConfig()
+	config.ForceBootProtocol = true
+	config.KeyboardNKRO = true
+	applied, err := applyBootProtocol(config)
+	if err != nil {
+		t.Fatalf("applyBootProtocol: %s", err.Error())
+	}
+	if applied.KeyboardNKRO {
+		t.Errorf("expected NKRO to be disabled")
+	}
+
+	config.KeyboardDescriptor = "/etc/go-hidproxy/keyboard.bin"
+	if _, err := applyBootProtocol(config); err == nil {
+		t.Errorf("expected an error with a keyboard descriptor override")
+	}
+
+	config.KeyboardDescriptor = ""
+	config.CompositeGadget = true
+	if _, err := applyBootProtocol(config); err == nil {
+		t.Errorf("expected an error with a composite gadget")
+	}
+}
@@ -0,0 +1,47 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+// Consumer control (usage page 0x0C) report: a single 16-bit usage
+var ConsumerReportDescriptor = []byte{
+	0x05, 0x0c, // Usage Page (Consumer)
+	0x09, 0x01, // Usage (Consumer Control)
+	0xa1, 0x01, // Collection (Application)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x26, 0xff, 0x03, //   Logical Maximum (0x3ff)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x2a, 0xff, 0x03, //   Usage Maximum (0x3ff)
+	0x75, 0x10, //   Report Size (16)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x00, //   Input (Data, Array, Absolute)
+	0xc0, // End Collection
+}
+
+// Evdev key codes to consumer control usage IDs
+var ConsumerCodes = map[uint16]uint16{
+	113: 0x00e2, // Mute
+	114: 0x00ea, // VolDn
+	115: 0x00e9, // VolUp
+	163: 0x00b5, // Next-Track
+	164: 0x00cd, // Play-Pause
+	165: 0x00b6, // Previous-Track
+	166: 0x00b7, // Stop
+	161: 0x00b8, // Eject
+	168: 0x00b4, // Rewind
+	208: 0x00b3, // Fast-Forward
+	200: 0x00b0, // Play
+	201: 0x00b1, // Pause
+	224: 0x0070, // Brightness-Down
+	225: 0x006f, // Brightness-Up
+	140: 0x0192, // Calculator
+	150: 0x0196, // WWW
+	155: 0x018a, // Mail
+	172: 0x0223, // Homepage
+	217: 0x0221, // Search
+}
+
+func ConsumerReport(usage uint16) []byte {
+	return []byte{uint8(usage & 0xff), uint8(usage >> 8)}
+}
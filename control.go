@@ -0,0 +1,204 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PauseState stops forwarding reports to the host while paused
+type PauseState struct {
+	mu      sync.Mutex
+	paused  bool
+	changed chan struct{}
+}
+
+func NewPauseState() *PauseState {
+	return &PauseState{
+		changed: make(chan struct{}),
+	}
+}
+
+func (s *PauseState) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// Returns a channel that is closed when the state next changes
+func (s *PauseState) Changed() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.changed
+}
+
+func (s *PauseState) Set(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if paused == s.paused {
+		return
+	}
+	s.paused = paused
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Toggles forwarding and returns true if it is now paused
+func (s *PauseState) Toggle() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = !s.paused
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return s.paused
+}
+
+// An attached input device, as returned by Proxy.Devices
+type DeviceInfo struct {
+	Name    string `json:"name"`
+	Device  string `json:"device"`
+	Address string `json:"address,omitempty"`
+	// The role the device is proxied in (keyboard, mouse etc.)
+	Type string `json:"type"`
+	// Battery level in percent, if reported by the device
+	Battery *int `json:"battery,omitempty"`
+	// Events forwarded to the host since the device was attached
+	Events uint64 `json:"events"`
+	// Set after the device went silent with keys or buttons held
+	Stale bool `json:"stale,omitempty"`
+}
+
+// Incremented when fields of StatusReport change meaning or are removed,
+// adding fields doesn't change it
+const STATUS_SCHEMA_VERSION = 1
+
+// StatusReport is the state of the proxy returned by the status command
+type StatusReport struct {
+	SchemaVersion int  `json:"schema_version"`
+	Paused        bool `json:"paused"`
+	// Where reports are written, local or net
+	Output string `json:"output"`
+	// The UDC the gadget is bound to and its state, eg. "configured"
+	Udc  string `json:"udc,omitempty"`
+	Host string `json:"host"`
+	// True while the gadget is asleep after idle-timeout
+	Asleep  bool         `json:"asleep"`
+	Devices []DeviceInfo `json:"devices"`
+}
+
+type ControlResponse struct {
+	Ok      bool          `json:"ok"`
+	Error   string        `json:"error,omitempty"`
+	Paused  *bool         `json:"paused,omitempty"`
+	Status  *StatusReport `json:"status,omitempty"`
+	Devices *[]DeviceInfo `json:"devices,omitempty"`
+}
+
+// Status returns the state of the proxy and the attached devices
+func (p *Proxy) Status() StatusReport {
+	status := StatusReport{
+		SchemaVersion: STATUS_SCHEMA_VERSION,
+		Paused:        p.pause.Paused(),
+		Output:        p.Config().OutputMode,
+		Host:          p.HostState(),
+		Devices:       p.Devices(),
+	}
+	if status.Host != "" {
+		status.Udc = udcName()
+	}
+	if p.idle != nil {
+		status.Asleep = p.idle.Asleep()
+	}
+	return status
+}
+
+// Runs a control socket command
+func (p *Proxy) Command(command string) ControlResponse {
+	switch strings.TrimSpace(command) {
+	case "status":
+		status := p.Status()
+		return ControlResponse{Ok: true, Status: &status}
+	case "list-devices":
+		devices := p.Devices()
+		return ControlResponse{Ok: true, Devices: &devices}
+	case "pause":
+		log.Info("Pausing forwarding of input")
+		p.pause.Set(true)
+		paused := true
+		return ControlResponse{Ok: true, Paused: &paused}
+	case "resume":
+		log.Info("Resuming forwarding of input")
+		p.pause.Set(false)
+		paused := false
+		return ControlResponse{Ok: true, Paused: &paused}
+	case "pair":
+		config := p.Config()
+		window := time.Duration(config.PairingTimeout) * time.Second
+		go func() {
+			if err := PairDevices(context.Background(), config.Adapters(), window); err != nil {
+				log.Warnf("Pairing failed: %s", err.Error())
+			}
+		}()
+		return ControlResponse{Ok: true}
+	case "reload":
+		p.Reload()
+		return ControlResponse{Ok: true}
+	}
+	return ControlResponse{Ok: false, Error: "unknown command: " + strings.TrimSpace(command)}
+}
+
+// ServeControl accepts line commands on a Unix domain socket, answering
+// each with a JSON response, until the context is cancelled.
+func (p *Proxy) ServeControl(ctx context.Context, path string) error {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Errorf("Unable to listen on control socket %s: %s", path, err.Error())
+		return err
+	}
+	os.Chmod(path, 0600)
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		os.Remove(path)
+	}()
+
+	log.Infof("Listening for commands on %s", path)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Warnf("Error accepting control connection: %s", err.Error())
+			continue
+		}
+		go p.handleControl(conn)
+	}
+}
+
+func (p *Proxy) handleControl(conn net.Conn) {
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		log.Debugf("Control command: %s", scanner.Text())
+		if err := encoder.Encode(p.Command(scanner.Text())); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"time"
+)
+
+// Debouncer drops key-downs that follow a key-down of the same key within
+// the window, along with their key-ups. Kernel autorepeat events (value 2)
+// are never dropped.
+type Debouncer struct {
+	Window   time.Duration
+	lastDown map[uint16]time.Time
+	bounced  map[uint16]bool
+}
+
+func NewDebouncer(window time.Duration) *Debouncer {
+	return &Debouncer{
+		Window:   window,
+		lastDown: make(map[uint16]time.Time, 0),
+		bounced:  make(map[uint16]bool, 0),
+	}
+}
+
+// Returns false if the key event is a bounce and should be dropped
+func (d *Debouncer) Accept(code uint16, state int32, at time.Time) bool {
+	if d == nil || d.Window <= 0 {
+		return true
+	}
+	switch state {
+	case 1: // Key down
+		last, ok := d.lastDown[code]
+		d.lastDown[code] = at
+		if ok && at.Sub(last) < d.Window {
+			d.bounced[code] = true
+			return false
+		}
+	case 0: // Key up
+		if d.bounced[code] {
+			delete(d.bounced, code)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Lowercases a MAC address and uses colons as separators
+func NormalizeMac(mac string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(mac), "-", ":"))
+}
+
+// Returns the unique identifier of an evdev device, which for Bluetooth
+// devices is the MAC address of the device.
+func InputDeviceAddress(path string) string {
+	content, err := ioutil.ReadFile(filepath.Join("/sys/class/input", filepath.Base(path), "device/uniq"))
+	if err != nil {
+		return ""
+	}
+	return NormalizeMac(string(content))
+}
+
+// Returns the Bluetooth adapter (eg. hci0) found in a sysfs device path,
+// or an empty string if the path doesn't belong to a Bluetooth device.
+func adapterFromPath(path string) string {
+	for _, part := range strings.Split(path, "/") {
+		if strings.HasPrefix(part, "hci") && !strings.Contains(part, ":") {
+			return part
+		}
+	}
+	return ""
+}
+
+// Returns the Bluetooth adapter an evdev device is connected through
+func InputDeviceAdapter(path string) string {
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/class/input", filepath.Base(path), "device"))
+	if err != nil {
+		return ""
+	}
+	return adapterFromPath(sysPath)
+}
+
+func macInList(mac string, list []string) bool {
+	for _, m := range list {
+		if NormalizeMac(m) == mac {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the name of an evdev device as reported by the kernel
+func InputDeviceName(path string) string {
+	content, err := ioutil.ReadFile(filepath.Join("/sys/class/input", filepath.Base(path), "device/name"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// Returns the /dev/input/by-id symlinks pointing to an evdev device
+func InputDeviceIds(path string) []string {
+	ids := make([]string, 0)
+	links, err := filepath.Glob("/dev/input/by-id/*")
+	if err != nil {
+		return ids
+	}
+	for _, link := range links {
+		target, err := filepath.EvalSymlinks(link)
+		if err == nil && target == path {
+			ids = append(ids, link)
+		}
+	}
+	return ids
+}
+
+const INPUT_PROP_ACCELEROMETER = 0x06
+
+// Returns true if the device is an accelerometer or another motion sensor,
+// which some keyboards and gamepads expose as an extra evdev node
+func isSensor(path string) bool {
+	content, err := ioutil.ReadFile(filepath.Join("/sys/class/input", filepath.Base(path), "device/properties"))
+	if err != nil {
+		return false
+	}
+	// Bitmap in hex words, the lowest bits come last
+	words := strings.Fields(string(content))
+	if len(words) == 0 {
+		return false
+	}
+	props, err := strconv.ParseUint(words[len(words)-1], 16, 64)
+	return err == nil && props&(1<<INPUT_PROP_ACCELEROMETER) != 0
+}
+
+// System control keys (KEY_POWER, KEY_SLEEP, KEY_WAKEUP), usually found on
+// a node of their own
+var SystemControlCodes = map[uint16]bool{116: true, 142: true, 143: true}
+
+// The kinds of keys a device has
+type deviceKeys struct {
+	keys     bool // Keys sent to the host, remapped keys and macro triggers
+	consumer bool
+	system   bool
+}
+
+func inspectKeys(dev evdev.InputDevice, remap map[uint16]uint16, macros *Macros) deviceKeys {
+	var keys deviceKeys
+	for k, codes := range dev.Capabilities {
+		if k.Type != evdev.EV_KEY {
+			continue
+		}
+		for _, c := range codes {
+			code := uint16(c.Code)
+			_, known := HidUsage(code, true)
+			_, remapped := remap[code]
+			macro := false
+			if macros != nil {
+				_, macro = macros.Steps[code]
+			}
+			switch {
+			case known || remapped || macro:
+				keys.keys = true
+			case ConsumerCodes[code] != 0:
+				keys.consumer = true
+			case SystemControlCodes[code]:
+				keys.system = true
+			}
+		}
+	}
+	return keys
+}
+
+// Checks that the device match patterns are valid
+func CheckDevicePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "re:") {
+			if _, err := regexp.Compile(pattern[3:]); err != nil {
+				return fmt.Errorf("invalid device pattern %q: %w", pattern, err)
+			}
+		} else if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid device pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Matches the patterns against the device name and its by-id symlinks
+// (both the full path and the base name). Patterns are globs, or regular
+// expressions when prefixed with "re:".
+func MatchDevice(patterns []string, name string, ids []string) bool {
+	candidates := []string{name}
+	for _, id := range ids {
+		candidates = append(candidates, id, filepath.Base(id))
+	}
+	for _, pattern := range patterns {
+		for _, candidate := range candidates {
+			if candidate == "" {
+				continue
+			}
+			if strings.HasPrefix(pattern, "re:") {
+				if re, err := regexp.Compile(pattern[3:]); err == nil && re.MatchString(candidate) {
+					return true
+				}
+			} else if ok, _ := filepath.Match(pattern, candidate); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Checks the device against the allow and deny lists. Deny always wins,
+// and if AllowDevices or MatchDevices is set only devices listed in either
+// are let through.
+func DeviceAllowed(config Config, path string) bool {
+	if len(config.AllowDevices) == 0 && len(config.DenyDevices) == 0 && len(config.MatchDevices) == 0 {
+		return true
+	}
+	mac := InputDeviceAddress(path)
+	if mac != "" && macInList(mac, config.DenyDevices) {
+		log.Debugf("Device %s (%s) is in deny list, ignoring", path, mac)
+		return false
+	}
+	if len(config.AllowDevices) == 0 && len(config.MatchDevices) == 0 {
+		return true
+	}
+	if mac != "" && macInList(mac, config.AllowDevices) {
+		return true
+	}
+	if len(config.MatchDevices) > 0 && MatchDevice(config.MatchDevices, InputDeviceName(path), InputDeviceIds(path)) {
+		return true
+	}
+	log.Debugf("Device %s (%s) is not in allow list or matched, ignoring", path, mac)
+	return false
+}
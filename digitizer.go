@@ -0,0 +1,270 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/loov/hrtime"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Keeps the report within a 64 byte full speed packet
+	DIGITIZER_MAX_CONTACTS = 10
+	// Tip switch and padding, contact ID, 16-bit X and Y
+	DIGITIZER_CONTACT_LENGTH = 6
+)
+
+// Returns the touch screen report descriptor for up to contacts contacts.
+// Each report has all the contacts followed by the number of valid ones.
+func DigitizerReportDescriptor(contacts int) []byte {
+	desc := []byte{
+		0x05, 0x0d, // Usage Page (Digitizers)
+		0x09, 0x04, // Usage (Touch Screen)
+		0xa1, 0x01, // Collection (Application)
+	}
+	for i := 0; i < contacts; i++ {
+		desc = append(desc,
+			0x05, 0x0d, //   Usage Page (Digitizers)
+			0x09, 0x22, //   Usage (Finger)
+			0xa1, 0x02, //   Collection (Logical)
+			0x09, 0x42, //     Usage (Tip Switch)
+			0x15, 0x00, //     Logical Minimum (0)
+			0x25, 0x01, //     Logical Maximum (1)
+			0x75, 0x01, //     Report Size (1)
+			0x95, 0x01, //     Report Count (1)
+			0x81, 0x02, //     Input (Data, Variable, Absolute)
+			0x95, 0x07, //     Report Count (7)
+			0x81, 0x03, //     Input (Constant, Variable)
+			0x09, 0x51, //     Usage (Contact Identifier)
+			0x25, 0x7f, //     Logical Maximum (127)
+			0x75, 0x08, //     Report Size (8)
+			0x95, 0x01, //     Report Count (1)
+			0x81, 0x02, //     Input (Data, Variable, Absolute)
+			0x05, 0x01, //     Usage Page (Generic Desktop)
+			0x09, 0x30, //     Usage (X)
+			0x09, 0x31, //     Usage (Y)
+			0x16, 0x00, 0x00, //     Logical Minimum (0)
+			0x26, 0xff, 0x7f, //     Logical Maximum (32767)
+			0x75, 0x10, //     Report Size (16)
+			0x95, 0x02, //     Report Count (2)
+			0x81, 0x02, //     Input (Data, Variable, Absolute)
+			0xc0, //   End Collection
+		)
+	}
+	return append(desc,
+		0x05, 0x0d, //   Usage Page (Digitizers)
+		0x09, 0x54, //   Usage (Contact Count)
+		0x15, 0x00, //   Logical Minimum (0)
+		0x25, uint8(contacts), //   Logical Maximum (contacts)
+		0x75, 0x08, //   Report Size (8)
+		0x95, 0x01, //   Report Count (1)
+		0x81, 0x02, //   Input (Data, Variable, Absolute)
+		0x09, 0x55, //   Usage (Contact Count Maximum)
+		0xb1, 0x02, //   Feature (Data, Variable, Absolute)
+		0xc0, // End Collection
+	)
+}
+
+func DigitizerReportLength(contacts int) int {
+	return contacts*DIGITIZER_CONTACT_LENGTH + 1
+}
+
+// Checks the configured number of contacts
+func CheckMaxContacts(contacts int) error {
+	if contacts < 1 || contacts > DIGITIZER_MAX_CONTACTS {
+		return fmt.Errorf("max-contacts must be between 1 and %d", DIGITIZER_MAX_CONTACTS)
+	}
+	return nil
+}
+
+// Returns true for multitouch devices using slots (protocol B)
+func isMultitouch(dev evdev.InputDevice) bool {
+	return hasCapability(dev, evdev.EV_ABS, evdev.ABS_MT_SLOT) &&
+		hasCapability(dev, evdev.EV_ABS, evdev.ABS_MT_TRACKING_ID) &&
+		hasCapability(dev, evdev.EV_ABS, evdev.ABS_MT_POSITION_X) &&
+		hasCapability(dev, evdev.EV_ABS, evdev.ABS_MT_POSITION_Y)
+}
+
+// A contact in a multitouch slot
+type TouchContact struct {
+	Active bool
+	Id     uint8
+	X      uint16
+	Y      uint16
+	// Lifted contacts are reported once more with the tip switch off
+	lifted bool
+}
+
+// DigitizerTranslator tracks the multitouch slots of a device and turns
+// them into touch screen reports on every SYN_REPORT that changed them.
+type DigitizerTranslator struct {
+	Contacts []TouchContact
+	AbsX     AbsInfo
+	AbsY     AbsInfo
+	Input    chan<- InputMessage
+	Device   evdev.InputDevice
+
+	slot    int
+	changed bool
+}
+
+func NewDigitizerTranslator(input chan<- InputMessage, contacts int, absX AbsInfo, absY AbsInfo, dev evdev.InputDevice) *DigitizerTranslator {
+	return &DigitizerTranslator{
+		Contacts: make([]TouchContact, contacts),
+		AbsX:     absX,
+		AbsY:     absY,
+		Input:    input,
+		Device:   dev,
+	}
+}
+
+// Returns the report with the active contacts and the ones just lifted
+func (t *DigitizerTranslator) Report() []byte {
+	report := make([]byte, DigitizerReportLength(len(t.Contacts)))
+	count := 0
+	for _, contact := range t.Contacts {
+		if !contact.Active && !contact.lifted {
+			continue
+		}
+		entry := report[count*DIGITIZER_CONTACT_LENGTH:]
+		if contact.Active {
+			entry[0] = 0x01
+		}
+		entry[1] = contact.Id
+		entry[2], entry[3] = uint8(contact.X&0xff), uint8(contact.X>>8)
+		entry[4], entry[5] = uint8(contact.Y&0xff), uint8(contact.Y>>8)
+		count++
+	}
+	report[len(report)-1] = uint8(count)
+	return report
+}
+
+func (t *DigitizerTranslator) send(event *evdev.InputEvent) {
+	report := t.Report()
+	t.Input <- InputMessage{Timestamp: hrtime.Now(), Message: report}
+	LogEvent(t.Device, event, report)
+	for i := range t.Contacts {
+		t.Contacts[i].lifted = false
+	}
+	t.changed = false
+}
+
+// Lifts all the contacts, eg. when the device goes away
+func (t *DigitizerTranslator) ReleaseAll() {
+	active := false
+	for i := range t.Contacts {
+		if t.Contacts[i].Active {
+			t.Contacts[i].Active, t.Contacts[i].lifted = false, true
+			active = true
+		}
+	}
+	if active {
+		log.Infof("Lifting contacts held on %s (%s)", t.Device.Name, t.Device.Fn)
+		t.send(&evdev.InputEvent{Type: evdev.EV_SYN, Code: evdev.SYN_REPORT})
+	}
+}
+
+func (t *DigitizerTranslator) Event(event *evdev.InputEvent) {
+	if event.Type == evdev.EV_SYN && event.Code == evdev.SYN_REPORT {
+		if t.changed {
+			t.send(event)
+		}
+		return
+	}
+	if event.Type != evdev.EV_ABS {
+		return
+	}
+	if event.Code == evdev.ABS_MT_SLOT {
+		t.slot = int(event.Value)
+		return
+	}
+	// Slots beyond the contacts of the report are ignored
+	if t.slot < 0 || t.slot >= len(t.Contacts) {
+		return
+	}
+	contact := &t.Contacts[t.slot]
+	switch event.Code {
+	case evdev.ABS_MT_TRACKING_ID:
+		if event.Value < 0 {
+			if contact.Active {
+				contact.Active, contact.lifted = false, true
+			}
+		} else {
+			contact.Active, contact.lifted = true, false
+			contact.Id = uint8(event.Value & 0x7f)
+		}
+	case evdev.ABS_MT_POSITION_X:
+		contact.X = t.AbsX.Scale(event.Value)
+	case evdev.ABS_MT_POSITION_Y:
+		contact.Y = t.AbsY.Scale(event.Value)
+	default:
+		return
+	}
+	t.changed = true
+}
+
+func HandleDigitizer(ctx context.Context, output chan<- error, input chan<- InputMessage, contacts int, grab bool, dev evdev.InputDevice) error {
+	defer dev.File.Close()
+	if grab && GrabDevice(dev) {
+		defer dev.Release()
+	}
+
+	log.Infof("Reading multitouch device: %s (%s)", dev.Name, dev.Fn)
+	syscall.SetNonblock(int(dev.File.Fd()), true)
+
+	absX, err := GetAbsInfo(dev, evdev.ABS_MT_POSITION_X)
+	if err == nil {
+		var absY AbsInfo
+		absY, err = GetAbsInfo(dev, evdev.ABS_MT_POSITION_Y)
+		if err == nil {
+			log.Debugf("Digitizer %s axis ranges: X %d-%d, Y %d-%d", dev.Name, absX.Minimum, absX.Maximum, absY.Minimum, absY.Maximum)
+			translator := NewDigitizerTranslator(input, contacts, absX, absY, dev)
+			err = handleDigitizerEvents(ctx, translator)
+			translator.ReleaseAll()
+		}
+	}
+	if err != nil {
+		log.Errorf("Error reading from %s (%s): %s", dev.Name, dev.Fn, err.Error())
+		output <- err
+		return err
+	}
+	log.Infof("Stopping processing multitouch input from: %s (%s)", dev.Name, dev.Fn)
+	output <- nil
+	return nil
+}
+
+func handleDigitizerEvents(ctx context.Context, translator *DigitizerTranslator) error {
+	dev := translator.Device
+	// The current slot is only reported when it changes
+	if slot, err := GetAbsInfo(dev, evdev.ABS_MT_SLOT); err == nil {
+		translator.slot = int(slot.Value)
+	}
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		err := dev.File.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		if err != nil {
+			return err
+		}
+
+		event, err := dev.ReadOne()
+		if err != nil && strings.Contains(err.Error(), "i/o timeout") {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		log.Debugf("Multitouch input event: type=%d, code=%d, value=%d", event.Type, event.Code, event.Value)
+		translator.Event(event)
+	}
+}
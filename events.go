@@ -0,0 +1,67 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"encoding/hex"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// Logs every forwarded event as JSON when LogEvents is set
+var eventLogger *log.Logger
+
+// EventCounts counts the events forwarded from each device, by evdev path
+type EventCounts struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+var Forwarded = &EventCounts{counts: make(map[string]uint64, 0)}
+
+func (c *EventCounts) Inc(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[path]++
+}
+
+func (c *EventCounts) Get(path string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[path]
+}
+
+func (c *EventCounts) Reset(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.counts, path)
+}
+
+func EnableEventLog() {
+	eventLogger = &log.Logger{
+		Out:       log.StandardLogger().Out,
+		Formatter: &log.JSONFormatter{},
+		Hooks:     make(log.LevelHooks),
+		Level:     log.InfoLevel,
+	}
+}
+
+// Counts an evdev event forwarded as a HID report, and logs both if
+// LogEvents is set
+func LogEvent(dev evdev.InputDevice, event *evdev.InputEvent, report []byte) {
+	Forwarded.Inc(dev.Fn)
+	if eventLogger == nil {
+		return
+	}
+	eventLogger.WithFields(log.Fields{
+		"device": dev.Name,
+		"path":   dev.Fn,
+		"type":   event.Type,
+		"code":   event.Code,
+		"value":  event.Value,
+		"report": hex.EncodeToString(report),
+	}).Info("event")
+}
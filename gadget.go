@@ -0,0 +1,69 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	orderedmap "github.com/wk8/go-ordered-map"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Returns true if the existing gadget has exactly the given functions and
+// all the attributes (file to content, as written by SetupUSBGadget) and
+// report descriptors. Attributes read back with a trailing newline.
+func gadgetMatches(gadget string, attributes *orderedmap.OrderedMap, descriptors map[string][]byte) bool {
+	functions, _ := filepath.Glob(gadget + "/functions/*")
+	if len(functions) != len(descriptors) {
+		return false
+	}
+	for pair := attributes.Oldest(); pair != nil; pair = pair.Next() {
+		content, err := ioutil.ReadFile(pair.Key.(string))
+		if err != nil || strings.TrimSuffix(string(content), "\n") != pair.Value.(string) {
+			log.Debugf("USB gadget attribute %s differs", pair.Key.(string))
+			return false
+		}
+	}
+	for file, desc := range descriptors {
+		content, err := ioutil.ReadFile(file)
+		if err != nil || !bytes.Equal(content, desc) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks for a gadget left over from a previous run, reusing it if allowed
+// and its attributes and descriptors match and removing it otherwise. Warns
+// about gadgets of other tools holding the UDC.
+func checkExistingGadget(gadget string, reuse bool, attributes *orderedmap.OrderedMap, descriptors map[string][]byte) {
+	others, _ := filepath.Glob(filepath.Join(filepath.Dir(gadget), "*"))
+	for _, other := range others {
+		if other == gadget {
+			continue
+		}
+		content, err := ioutil.ReadFile(other + "/UDC")
+		if udc := strings.TrimSpace(string(content)); err == nil && udc != "" {
+			log.Warnf("USB gadget %s is bound to UDC %s, remove it or binding the gadget will fail", other, udc)
+		}
+	}
+
+	if _, err := os.Stat(gadget); os.IsNotExist(err) {
+		return
+	}
+	if reuse && gadgetMatches(gadget, attributes, descriptors) {
+		log.Infof("Reusing existing USB gadget %s", gadget)
+		return
+	}
+	if reuse {
+		log.Warnf("Existing USB gadget %s has different functions, attributes or descriptors, recreating it", gadget)
+	} else {
+		log.Warnf("USB gadget %s already exists, recreating it", gadget)
+	}
+	teardownGadget(gadget)
+}
@@ -0,0 +1,138 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	orderedmap "github.com/wk8/go-ordered-map"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGadgetMatches(t *testing.T) {
+	write := func(gadget string, file string, content string) {
+		path := filepath.Join(gadget, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An existing gadget as configfs shows it, attributes end in a newline
+	existing := func() string {
+		gadget := t.TempDir()
+		write(gadget, "idVendor", "0x1d6b\n")
+		write(gadget, "idProduct", "0x0104\n")
+		write(gadget, "strings/0x409/product", "go-hidproxy\n")
+		write(gadget, "functions/hid.usb0/protocol", "1\n")
+		write(gadget, "functions/hid.usb0/subclass", "1\n")
+		write(gadget, "functions/hid.usb0/report_length", "8\n")
+		write(gadget, "functions/hid.usb0/report_desc", string(KeyboardReportDescriptor))
+		return gadget
+	}
+	expected := func(gadget string, changed string, value string) (*orderedmap.OrderedMap, map[string][]byte) {
+		attributes := orderedmap.New()
+		for _, attribute := range [][]string{
+			{"idVendor", "0x1d6b"},
+			{"idProduct", "0x0104"},
+			{"strings/0x409/product", "go-hidproxy"},
+			{"functions/hid.usb0/protocol", "1"},
+			{"functions/hid.usb0/subclass", "1"},
+			{"functions/hid.usb0/report_length", "8"},
+		} {
+			if attribute[0] == changed {
+				attribute[1] = value
+			}
+			attributes.Set(filepath.Join(gadget, attribute[0]), attribute[1])
+		}
+		desc := KeyboardReportDescriptor
+		if changed == "functions/hid.usb0/report_desc" {
+			desc = KeyboardNKROReportDescriptor
+		}
+		return attributes, map[string][]byte{filepath.Join(gadget, "functions/hid.usb0/report_desc"): desc}
+	}
+
+	tests := []struct {
+		changed  string
+		value    string
+		expected bool
+	}{
+		{"", "", true},
+		{"idVendor", "0x1209", false},
+		{"idProduct", "0x0001", false},
+		{"strings/0x409/product", "keyboard", false},
+		{"functions/hid.usb0/protocol", "0", false},
+		{"functions/hid.usb0/subclass", "0", false},
+		{"functions/hid.usb0/report_length", "20", false},
+		{"functions/hid.usb0/report_desc", "", false},
+	}
+	for _, test := range tests {
+		gadget := existing()
+		attributes, descriptors := expected(gadget, test.changed, test.value)
+		if matches := gadgetMatches(gadget, attributes, descriptors); matches != test.expected {
+			t.Errorf("changed %q: expected %t, got %t", test.changed, test.expected, matches)
+		}
+	}
+
+	// An extra function
+	gadget := existing()
+	write(gadget, "functions/hid.usb1/report_desc", string(MouseReportDescriptor))
+	if attributes, descriptors := expected(gadget, "", ""); gadgetMatches(gadget, attributes, descriptors) {
+		t.Errorf("expected a gadget with an extra function not to match")
+	}
+}
+
+func TestCheckExistingGadget(t *testing.T) {
+	write := func(path string, content string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name     string
+		reuse    bool
+		vendorId string
+		torndown bool
+	}{
+		{"reused", true, "0x1d6b", false},
+		{"different attribute", true, "0x1209", true},
+		{"reuse disabled", false, "0x1d6b", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			gadget := filepath.Join(t.TempDir(), "piproxy")
+			function := filepath.Join(gadget, "functions/hid.usb0")
+			link := filepath.Join(gadget, "configs/c.1/hid.usb0")
+			write(filepath.Join(gadget, "UDC"), "fe980000.usb\n")
+			write(filepath.Join(gadget, "idVendor"), "0x1d6b\n")
+			write(filepath.Join(function, "report_desc"), string(KeyboardReportDescriptor))
+			write(filepath.Join(gadget, "configs/c.1/MaxPower"), "250\n")
+			if err := os.Symlink(function, link); err != nil {
+				t.Fatal(err)
+			}
+
+			attributes := orderedmap.New()
+			attributes.Set(filepath.Join(gadget, "idVendor"), test.vendorId)
+			descriptors := map[string][]byte{filepath.Join(function, "report_desc"): KeyboardReportDescriptor}
+			checkExistingGadget(gadget, test.reuse, attributes, descriptors)
+
+			// Outside configfs the directories holding attributes can't be
+			// removed, but the gadget is unbound and its links removed
+			udc, err := ioutil.ReadFile(filepath.Join(gadget, "UDC"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = os.Lstat(link)
+			if torndown := string(udc) == "\n" && os.IsNotExist(err); torndown != test.torndown {
+				t.Errorf("expected torn down %t, got UDC %q and link error %v", test.torndown, udc, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/loov/hrtime"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Gamepad report: 16 buttons, hat switch, X/Y/Z/Rz axes (-127 to 127)
+var GamepadReportDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x05, // Usage (Game Pad)
+	0xa1, 0x01, // Collection (Application)
+	0x05, 0x09, //   Usage Page (Button)
+	0x19, 0x01, //   Usage Minimum (1)
+	0x29, 0x10, //   Usage Maximum (16)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x10, //   Report Count (16)
+	0x81, 0x02, //   Input (Data, Variable, Absolute)
+	0x05, 0x01, //   Usage Page (Generic Desktop)
+	0x09, 0x39, //   Usage (Hat switch)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x07, //   Logical Maximum (7)
+	0x35, 0x00, //   Physical Minimum (0)
+	0x46, 0x3b, 0x01, //   Physical Maximum (315)
+	0x65, 0x14, //   Unit (Degrees)
+	0x75, 0x04, //   Report Size (4)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x42, //   Input (Data, Variable, Absolute, Null State)
+	0x65, 0x00, //   Unit (None)
+	0x75, 0x04, //   Report Size (4)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x01, //   Input (Constant)
+	0x09, 0x30, //   Usage (X)
+	0x09, 0x31, //   Usage (Y)
+	0x09, 0x32, //   Usage (Z)
+	0x09, 0x35, //   Usage (Rz)
+	0x15, 0x81, //   Logical Minimum (-127)
+	0x25, 0x7f, //   Logical Maximum (127)
+	0x75, 0x08, //   Report Size (8)
+	0x95, 0x04, //   Report Count (4)
+	0x81, 0x02, //   Input (Data, Variable, Absolute)
+	0xc0, // End Collection
+}
+
+const (
+	GAMEPAD_REPORT_LENGTH = 7
+	GAMEPAD_HAT_NULL      = 8
+)
+
+// Evdev BTN_JOYSTICK (0x120) and BTN_GAMEPAD (0x130) ranges
+const (
+	btnJoystick = 0x120
+	btnGamepad  = 0x130
+)
+
+// Returns the report button index of an evdev button code
+func GamepadButton(code uint16) (uint8, bool) {
+	switch {
+	case code >= btnGamepad && code < btnGamepad+0x10:
+		return uint8(code - btnGamepad), true
+	case code >= btnJoystick && code < btnJoystick+0x10:
+		return uint8(code - btnJoystick), true
+	}
+	return 0, false
+}
+
+// Converts ABS_HAT0X/ABS_HAT0Y directions to a hat switch value, clockwise
+// from north, or GAMEPAD_HAT_NULL when centered.
+func HatSwitch(x int32, y int32) uint8 {
+	switch {
+	case x == 0 && y < 0:
+		return 0
+	case x > 0 && y < 0:
+		return 1
+	case x > 0 && y == 0:
+		return 2
+	case x > 0 && y > 0:
+		return 3
+	case x == 0 && y > 0:
+		return 4
+	case x < 0 && y > 0:
+		return 5
+	case x < 0 && y == 0:
+		return 6
+	case x < 0 && y < 0:
+		return 7
+	}
+	return GAMEPAD_HAT_NULL
+}
+
+// Normalizes an axis value from the device range to -127 to 127
+func (a AbsInfo) Normalize(value int32) int8 {
+	if a.Maximum <= a.Minimum {
+		return 0
+	}
+	if value < a.Minimum {
+		value = a.Minimum
+	}
+	if value > a.Maximum {
+		value = a.Maximum
+	}
+	return int8(int64(value-a.Minimum)*254/int64(a.Maximum-a.Minimum) - 127)
+}
+
+type GamepadState struct {
+	Buttons uint16
+	HatX    int32
+	HatY    int32
+	Axes    [4]int8 // X, Y, Z, Rz
+}
+
+func (g GamepadState) Report() []uint8 {
+	return []uint8{
+		uint8(g.Buttons & 0xff), uint8(g.Buttons >> 8),
+		HatSwitch(g.HatX, g.HatY),
+		uint8(g.Axes[0]), uint8(g.Axes[1]), uint8(g.Axes[2]), uint8(g.Axes[3]),
+	}
+}
+
+// Returns true for devices with absolute axes and joystick or gamepad buttons
+func isGamepad(dev evdev.InputDevice) bool {
+	if !hasCapability(dev, evdev.EV_ABS, evdev.ABS_X) {
+		return false
+	}
+	for code := btnJoystick; code < btnGamepad+0x10; code++ {
+		if hasCapability(dev, evdev.EV_KEY, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Maps evdev axes to report axes. Pads with a right stick (ABS_RX/ABS_RY)
+// report it as Z/Rz, others use ABS_Z/ABS_RZ.
+func gamepadAxes(dev evdev.InputDevice) map[uint16]int {
+	axes := map[uint16]int{evdev.ABS_X: 0, evdev.ABS_Y: 1}
+	if hasCapability(dev, evdev.EV_ABS, evdev.ABS_RX) && hasCapability(dev, evdev.EV_ABS, evdev.ABS_RY) {
+		axes[evdev.ABS_RX], axes[evdev.ABS_RY] = 2, 3
+	} else {
+		axes[evdev.ABS_Z], axes[evdev.ABS_RZ] = 2, 3
+	}
+	return axes
+}
+
+func HandleGamepad(ctx context.Context, output chan<- error, input chan<- InputMessage, grab bool, dev evdev.InputDevice) error {
+	defer dev.File.Close()
+	if grab && GrabDevice(dev) {
+		defer dev.Release()
+	}
+
+	log.Infof("Reading gamepad-like device: %s (%s)", dev.Name, dev.Fn)
+	syscall.SetNonblock(int(dev.File.Fd()), true)
+
+	axes := gamepadAxes(dev)
+	ranges := make(map[uint16]AbsInfo, len(axes))
+	var state GamepadState
+	for code, axis := range axes {
+		if !hasCapability(dev, evdev.EV_ABS, int(code)) {
+			continue
+		}
+		info, err := GetAbsInfo(dev, int(code))
+		if err != nil {
+			log.Warnf("Unable to read range of axis %d on %s (%s): %s", code, dev.Name, dev.Fn, err.Error())
+			continue
+		}
+		log.Debugf("Gamepad %s axis %d range: %d-%d", dev.Name, code, info.Minimum, info.Maximum)
+		ranges[code] = info
+		state.Axes[axis] = info.Normalize(info.Value)
+	}
+
+	changed := false
+	defer func() {
+		if state.Buttons != 0 || state.HatX != 0 || state.HatY != 0 {
+			log.Infof("Releasing buttons held on %s (%s)", dev.Name, dev.Fn)
+			input <- InputMessage{Timestamp: hrtime.Now(), Message: GamepadState{}.Report()}
+		}
+	}()
+	for {
+		if ctx.Err() != nil {
+			log.Infof("Stopping processing gamepad input from: %s (%s)", dev.Name, dev.Fn)
+			output <- nil
+			return nil
+		}
+
+		err := dev.File.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		if err != nil {
+			log.Fatal(err)
+			output <- err
+			return err
+		}
+
+		event, err := dev.ReadOne()
+		if err != nil && strings.Contains(err.Error(), "i/o timeout") {
+			continue
+		}
+		if err != nil {
+			log.Errorf("Error reading from %s (%s): %s", dev.Name, dev.Fn, err.Error())
+			output <- err
+			return err
+		}
+		log.Debugf("Gamepad input event: type=%d, code=%d, value=%d", event.Type, event.Code, event.Value)
+		switch event.Type {
+		case evdev.EV_KEY:
+			if button, ok := GamepadButton(event.Code); ok {
+				if event.Value > 0 {
+					state.Buttons |= 1 << button
+				} else {
+					state.Buttons &= ^(uint16(1) << button)
+				}
+				changed = true
+			}
+		case evdev.EV_ABS:
+			if axis, ok := axes[event.Code]; ok {
+				if info, ok := ranges[event.Code]; ok {
+					state.Axes[axis] = info.Normalize(event.Value)
+					changed = true
+				}
+			} else if event.Code == evdev.ABS_HAT0X {
+				state.HatX = event.Value
+				changed = true
+			} else if event.Code == evdev.ABS_HAT0Y {
+				state.HatY = event.Value
+				changed = true
+			}
+		case evdev.EV_SYN:
+			if event.Code == evdev.SYN_REPORT && changed {
+				report := state.Report()
+				input <- InputMessage{
+					Timestamp: hrtime.Now(),
+					Message:   report,
+				}
+				LogEvent(dev, event, report)
+				changed = false
+			}
+		}
+	}
+}
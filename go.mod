@@ -8,4 +8,5 @@ require (
 	github.com/muka/go-bluetooth v0.0.0-20201211051136-07f31c601d33
 	github.com/sirupsen/logrus v1.8.1
 	github.com/wk8/go-ordered-map v0.2.0
+	gopkg.in/yaml.v3 v3.0.1
 )
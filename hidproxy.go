@@ -8,30 +8,104 @@ import (
 	"bytes"
 	"context"
 	evdev "github.com/gvalkov/golang-evdev"
-	udev "github.com/jochenvg/go-udev"
 	"github.com/loov/hrtime"
-	"github.com/muka/go-bluetooth/api"
 	"github.com/muka/go-bluetooth/bluez/profile/adapter"
 	log "github.com/sirupsen/logrus"
 	orderedmap "github.com/wk8/go-ordered-map"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
 
 type Config struct {
-	SetupHid      bool
-	SetupMouse    bool
-	SetupKeyboard bool
-	MonitorUdev   bool
-	AdapterId     string
-	KbdRepeat     int
-	KbdDelay      int
-	LogLevel      log.Level
+	SetupHid             bool                         `yaml:"setuphid"`
+	SetupMouse           bool                         `yaml:"mouse"`
+	SetupKeyboard        bool                         `yaml:"keyboard"`
+	SetupConsumer        bool                         `yaml:"consumer"`
+	SetupTablet          bool                         `yaml:"tablet"`
+	SetupGamepad         bool                         `yaml:"gamepad"`
+	SetupDigitizer       bool                         `yaml:"digitizer"`
+	MaxContacts          int                          `yaml:"max-contacts"`
+	KeyboardNKRO         bool                         `yaml:"nkro"`
+	ForceBootProtocol    bool                         `yaml:"force-boot-protocol"`
+	MouseHiRes           bool                         `yaml:"mouse-hires"`
+	CompositeGadget      bool                         `yaml:"composite-gadget"`
+	VendorId             string                       `yaml:"vendor-id"`
+	ProductId            string                       `yaml:"product-id"`
+	Manufacturer         string                       `yaml:"manufacturer"`
+	Product              string                       `yaml:"product"`
+	SerialNumber         string                       `yaml:"serial-number"`
+	ReuseGadget          bool                         `yaml:"reuse-gadget"`
+	UdcName              string                       `yaml:"udc-name"`
+	UdcWaitTimeout       int                          `yaml:"udc-wait-timeout"`
+	KeyboardDescriptor   string                       `yaml:"keyboard-descriptor"`
+	MouseDescriptor      string                       `yaml:"mouse-descriptor"`
+	OutputMode           string                       `yaml:"output-mode"`
+	RemoteAddr           string                       `yaml:"remote-addr"`
+	ReceiveAddr          string                       `yaml:"receive-addr"`
+	ReceiveAllow         []string                     `yaml:"receive-allow"`
+	NetProtocol          string                       `yaml:"net-protocol"`
+	MouseScale           float64                      `yaml:"mouse-scale"`
+	MouseAccelThreshold  int                          `yaml:"mouse-accel-threshold"`
+	MouseAccelFactor     float64                      `yaml:"mouse-accel-factor"`
+	InvertScroll         bool                         `yaml:"invert-scroll"`
+	InvertHScroll        bool                         `yaml:"invert-hscroll"`
+	MouseButtonMap       map[string]string            `yaml:"mouse-button-map"`
+	MouseChords          map[string]string            `yaml:"mouse-chords"`
+	MouseChordMs         int                          `yaml:"mouse-chord-ms"`
+	MouseCoalesceMs      int                          `yaml:"mouse-coalesce-ms"`
+	MouseExtraButtons    bool                         `yaml:"mouse-extra-buttons"`
+	MonitorUdev          bool                         `yaml:"monitor-udev"`
+	GrabDevices          bool                         `yaml:"grab-devices"`
+	IncludeSystemControl bool                         `yaml:"include-system-control"`
+	IncludeSensors       bool                         `yaml:"include-sensors"`
+	AdapterId            string                       `yaml:"bluez-adapter"`
+	AdapterIds           []string                     `yaml:"bluez-adapters"`
+	ConnectKnown         bool                         `yaml:"connect-known"`
+	ConnectRetryInterval int                          `yaml:"connect-retry-interval"`
+	ConnectMaxAttempts   int                          `yaml:"connect-max-attempts"`
+	BatteryInterval      int                          `yaml:"battery-interval"`
+	PairingTimeout       int                          `yaml:"pairing-timeout"`
+	KbdRepeat            int                          `yaml:"kbdrepeat"`
+	KbdDelay             int                          `yaml:"kbddelay"`
+	KbdRepeatOverrides   map[string]RepeatConfig      `yaml:"kbdrepeat-overrides"`
+	SoftwareRepeat       bool                         `yaml:"software-repeat"`
+	DeviceRoles          map[string][]string          `yaml:"device-roles"`
+	DebounceMs           int                          `yaml:"debounce-ms"`
+	LinkTimeout          int                          `yaml:"link-timeout"`
+	SyncLeds             bool                         `yaml:"sync-leds"`
+	WriteRetries         int                          `yaml:"write-retries"`
+	EventQueueSize       int                          `yaml:"event-queue-size"`
+	IdleTimeout          int                          `yaml:"idle-timeout"`
+	IdleUnbind           bool                         `yaml:"idle-unbind"`
+	AllowDevices         []string                     `yaml:"allow-devices"`
+	DenyDevices          []string                     `yaml:"deny-devices"`
+	MatchDevices         []string                     `yaml:"match-devices"`
+	KeyRemap             map[string]string            `yaml:"key-remap"`
+	Layers               map[string]map[string]string `yaml:"layers"`
+	ToggleHotkey         string                       `yaml:"toggle-hotkey"`
+	Macros               map[string][]string          `yaml:"macros"`
+	MacroDelayMs         int                          `yaml:"macro-delay-ms"`
+	Layout               string                       `yaml:"layout"`
+	MetricsAddr          string                       `yaml:"metrics-addr"`
+	ControlSocket        string                       `yaml:"control-socket"`
+	LogLevel             log.Level                    `yaml:"loglevel"`
+	LogFile              string                       `yaml:"log-file"`
+	LogMaxSizeMB         int                          `yaml:"log-max-size-mb"`
+	LogEvents            bool                         `yaml:"log-events"`
+	MeasureLatency       bool                         `yaml:"measure-latency"`
+	Record               string                       `yaml:"record"`
+}
+
+// Keyboard repeat rate and delay (ms) of a single device. Zero values
+// use the global KbdRepeat and KbdDelay.
+type RepeatConfig struct {
+	Rate  int `yaml:"rate"`
+	Delay int `yaml:"delay"`
 }
 
 type InputDevice struct {
@@ -42,6 +116,9 @@ type InputDevice struct {
 type InputMessage struct {
 	Message   []byte
 	Timestamp time.Duration
+	// Relative motion without button changes, dropped first when the
+	// queue to the writer is full
+	Motion bool
 }
 
 var Scancodes = map[uint16]uint16{
@@ -144,6 +221,23 @@ var Scancodes = map[uint16]uint16{
 	163: 233, // Next-Track
 }
 
+// HidUsage returns the keyboard usage code of an evdev key code, and false
+// for keys without one that the keyboard report descriptor (NKRO or boot
+// protocol) can carry. Modifiers are always carried in the modifier byte.
+func HidUsage(code uint16, nkro bool) (uint16, bool) {
+	usage, ok := Scancodes[code]
+	if !ok {
+		return 0, false
+	}
+	if _, modifier := ModifierBit(usage); modifier {
+		return usage, true
+	}
+	if (nkro && usage < NKRO_KEYS) || (!nkro && usage <= BOOT_KEYBOARD_MAX_USAGE) {
+		return usage, true
+	}
+	return 0, false
+}
+
 const (
 	RIGHT_META    = 1 << 7
 	RIGHT_ALT     = 1 << 6
@@ -157,41 +251,163 @@ const (
 	BUTTON_LEFT   = 1 << 0
 	BUTTON_RIGHT  = 1 << 1
 	BUTTON_MIDDLE = 1 << 2
+	BUTTON_SIDE   = 1 << 3
+	BUTTON_EXTRA  = 1 << 4
+	// Buttons in the mouse report descriptor
+	MOUSE_BUTTON_COUNT = 5
+
+	// Reported in every key slot when too many keys are pressed
+	KEY_ERROR_ROLLOVER = 0x01
+	// Logical maximum of the keys in the boot protocol keyboard descriptor
+	BOOT_KEYBOARD_MAX_USAGE = 0x65
+
+	// N-key rollover bitmap covers usage codes 0x00-0xdf
+	NKRO_KEYS          = 0xe0
+	NKRO_REPORT_LENGTH = 1 + NKRO_KEYS/8
+
+	// Resolution multiplier of the high resolution mouse descriptor and
+	// the value of one wheel detent in REL_WHEEL_HI_RES units
+	MOUSE_WHEEL_MULTIPLIER    = 8
+	MOUSE_WHEEL_HI_RES_DETENT = 120
+	// Not defined by the evdev bindings
+	REL_WHEEL_HI_RES  = 11
+	REL_HWHEEL_HI_RES = 12
+
+	// Report IDs used with a composite gadget
+	KEYBOARD_REPORT_ID  = 1
+	MOUSE_REPORT_ID     = 2
+	CONSUMER_REPORT_ID  = 3
+	TABLET_REPORT_ID    = 4
+	GAMEPAD_REPORT_ID   = 5
+	DIGITIZER_REPORT_ID = 6
 )
 
-func SetupUSBGadget() {
+// Boot protocol keyboard: modifiers, reserved byte, 6 keys and LED output report
+var KeyboardReportDescriptor = []byte{0x05, 0x01, 0x09, 0x06, 0xa1, 0x01, 0x05, 0x07, 0x19, 0xe0, 0x29, 0xe7, 0x15, 0x00, 0x25, 0x01, 0x75, 0x01, 0x95, 0x08, 0x81, 0x02, 0x95, 0x01, 0x75, 0x08, 0x81, 0x03, 0x95, 0x05, 0x75, 0x01, 0x05, 0x08, 0x19, 0x01, 0x29, 0x05, 0x91, 0x02, 0x95, 0x01, 0x75, 0x03, 0x91, 0x03, 0x95, 0x06, 0x75, 0x08, 0x15, 0x00, 0x25, 0x65, 0x05, 0x07, 0x19, 0x00, 0x29, 0x65, 0x81, 0x00, 0xc0}
+
+// Boot protocol mouse: 5 buttons, X/Y and wheel
+var MouseReportDescriptor = []byte{0x05, 0x01, 0x09, 0x02, 0xa1, 0x01, 0x09, 0x01, 0xa1, 0x00, 0x05, 0x09, 0x19, 0x01, 0x29, 0x05, 0x15, 0x00, 0x25, 0x01, 0x95, 0x05, 0x75, 0x01, 0x81, 0x02, 0x95, 0x01, 0x75, 0x03, 0x81, 0x01, 0x05, 0x01, 0x09, 0x30, 0x09, 0x31, 0x09, 0x38, 0x15, 0x81, 0x25, 0x7f, 0x75, 0x08, 0x95, 0x03, 0x81, 0x06, 0xc0, 0xc0}
+
+// Mouse with 5 buttons, X/Y, wheel and AC Pan, both scroll axes having a
+// resolution multiplier (feature report) of up to 8
+var MouseHiResReportDescriptor = []byte{0x05, 0x01, 0x09, 0x02, 0xa1, 0x01, 0x09, 0x01, 0xa1, 0x00, 0x05, 0x09, 0x19, 0x01, 0x29, 0x05, 0x15, 0x00, 0x25, 0x01, 0x95, 0x05, 0x75, 0x01, 0x81, 0x02, 0x95, 0x01, 0x75, 0x03, 0x81, 0x01, 0x05, 0x01, 0x09, 0x30, 0x09, 0x31, 0x15, 0x81, 0x25, 0x7f, 0x75, 0x08, 0x95, 0x02, 0x81, 0x06, 0xa1, 0x02, 0x09, 0x48, 0x15, 0x00, 0x25, 0x01, 0x35, 0x01, 0x45, MOUSE_WHEEL_MULTIPLIER, 0x75, 0x02, 0x95, 0x01, 0xb1, 0x02, 0x35, 0x00, 0x45, 0x00, 0x09, 0x38, 0x15, 0x81, 0x25, 0x7f, 0x75, 0x08, 0x95, 0x01, 0x81, 0x06, 0xc0, 0xa1, 0x02, 0x09, 0x48, 0x15, 0x00, 0x25, 0x01, 0x35, 0x01, 0x45, MOUSE_WHEEL_MULTIPLIER, 0x75, 0x02, 0x95, 0x01, 0xb1, 0x02, 0x35, 0x00, 0x45, 0x00, 0x05, 0x0c, 0x0a, 0x38, 0x02, 0x15, 0x81, 0x25, 0x7f, 0x75, 0x08, 0x95, 0x01, 0x81, 0x06, 0xc0, 0x75, 0x04, 0x95, 0x01, 0xb1, 0x01, 0xc0, 0xc0}
+
+var KeyboardNKROReportDescriptor = []byte{0x05, 0x01, 0x09, 0x06, 0xa1, 0x01, 0x05, 0x07, 0x19, 0xe0, 0x29, 0xe7, 0x15, 0x00, 0x25, 0x01, 0x75, 0x01, 0x95, 0x08, 0x81, 0x02, 0x95, 0x05, 0x75, 0x01, 0x05, 0x08, 0x19, 0x01, 0x29, 0x05, 0x91, 0x02, 0x95, 0x01, 0x75, 0x03, 0x91, 0x03, 0x05, 0x07, 0x19, 0x00, 0x29, NKRO_KEYS - 1, 0x15, 0x00, 0x25, 0x01, 0x75, 0x01, 0x95, NKRO_KEYS, 0x81, 0x02, 0xc0}
+
+// Inserts a Report ID item after the first (application) collection item
+func WithReportId(desc []byte, reportId uint8) []byte {
+	for i := 0; i < len(desc); {
+		size := int(desc[i] & 0x03)
+		if size == 3 {
+			size = 4
+		}
+		if desc[i]&0xfc == 0xa0 { // Collection
+			next := i + 1 + size
+			result := append([]byte{}, desc[:next]...)
+			result = append(result, 0x85, reportId)
+			return append(result, desc[next:]...)
+		}
+		i += 1 + size
+	}
+	return desc
+}
+
+func SetupUSBGadget(config Config) {
 	var paths = []string{
 		"/sys/kernel/config/usb_gadget/piproxy",
 		"/sys/kernel/config/usb_gadget/piproxy/strings/0x409",
 		"/sys/kernel/config/usb_gadget/piproxy/configs/c.1/strings/0x409",
-		"/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb0",
-		"/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb1",
 	}
 	filesStr := orderedmap.New()
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/idVendor", "0x1d6b")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/idProduct", "0x0104")
+	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/idVendor", config.VendorId)
+	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/idProduct", config.ProductId)
 	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/bcdDevice", "0x0100")
 	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/bcdUSB", "0x0200")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/strings/0x409/serialnumber", "fedcba9876543210")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/strings/0x409/manufacturer", "Raspberry Pi")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/strings/0x409/product", "pizero keyboard Device")
+	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/strings/0x409/serialnumber", config.SerialNumber)
+	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/strings/0x409/manufacturer", config.Manufacturer)
+	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/strings/0x409/product", config.Product)
 	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/configs/c.1/strings/0x409/configuration", "Config 1: ECM network")
 	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/configs/c.1/MaxPower", "250")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb0/protocol", "1")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb0/subclass", "1")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb0/report_length", "8")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb1/protocol", "2")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb1/subclass", "1")
-	filesStr.Set("/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb1/report_length", "4")
-	var filesBytes = map[string][]byte{
-		"/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb0/report_desc": []byte{0x05, 0x01, 0x09, 0x06, 0xa1, 0x01, 0x05, 0x07, 0x19, 0xe0, 0x29, 0xe7, 0x15, 0x00, 0x25, 0x01, 0x75, 0x01, 0x95, 0x08, 0x81, 0x02, 0x95, 0x01, 0x75, 0x08, 0x81, 0x03, 0x95, 0x05, 0x75, 0x01, 0x05, 0x08, 0x19, 0x01, 0x29, 0x05, 0x91, 0x02, 0x95, 0x01, 0x75, 0x03, 0x91, 0x03, 0x95, 0x06, 0x75, 0x08, 0x15, 0x00, 0x25, 0x65, 0x05, 0x07, 0x19, 0x00, 0x29, 0x65, 0x81, 0x00, 0xc0},
-		"/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb1/report_desc": []byte{0x05, 0x01, 0x09, 0x02, 0xa1, 0x01, 0x09, 0x01, 0xa1, 0x00, 0x05, 0x09, 0x19, 0x01, 0x29, 0x05, 0x15, 0x00, 0x25, 0x01, 0x95, 0x05, 0x75, 0x01, 0x81, 0x02, 0x95, 0x01, 0x75, 0x03, 0x81, 0x01, 0x05, 0x01, 0x09, 0x30, 0x09, 0x31, 0x09, 0x38, 0x15, 0x81, 0x25, 0x7f, 0x75, 0x08, 0x95, 0x03, 0x81, 0x06, 0xc0, 0xc0},
+	var filesBytes = map[string][]byte{}
+	var symlinks = map[string]string{}
+
+	addFunction := func(name string, protocol int, subclass int, reportLength int, desc []byte) {
+		function := "/sys/kernel/config/usb_gadget/piproxy/functions/" + name
+		paths = append(paths, function)
+		filesStr.Set(function+"/protocol", strconv.Itoa(protocol))
+		filesStr.Set(function+"/subclass", strconv.Itoa(subclass))
+		filesStr.Set(function+"/report_length", strconv.Itoa(reportLength))
+		filesBytes[function+"/report_desc"] = desc
+		symlinks[function] = "/sys/kernel/config/usb_gadget/piproxy/configs/c.1/" + name
 	}
-	var symlinks = map[string]string{
-		"/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb0": "/sys/kernel/config/usb_gadget/piproxy/configs/c.1/hid.usb0",
-		"/sys/kernel/config/usb_gadget/piproxy/functions/hid.usb1": "/sys/kernel/config/usb_gadget/piproxy/configs/c.1/hid.usb1",
+
+	keyboardDesc, keyboardLength := KeyboardReportDescriptor, 8
+	keyboardSubclass := 1
+	if config.KeyboardNKRO {
+		// Bitmap reports are not boot protocol compatible
+		keyboardDesc, keyboardLength = KeyboardNKROReportDescriptor, NKRO_REPORT_LENGTH
+		keyboardSubclass = 0
+	}
+	mouseDesc, mouseLength := MouseReportDescriptor, 4
+	if config.MouseHiRes {
+		mouseDesc, mouseLength = MouseHiResReportDescriptor, 5
+	}
+	// The overrides must describe reports of the same layout and length
+	var err error
+	if config.KeyboardDescriptor != "" {
+		if keyboardDesc, err = LoadDescriptor(config.KeyboardDescriptor); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if config.MouseDescriptor != "" {
+		if mouseDesc, err = LoadDescriptor(config.MouseDescriptor); err != nil {
+			log.Fatal(err)
+		}
 	}
 
+	if config.CompositeGadget {
+		// A single function, reports prefixed with their report ID. Boot
+		// protocol reports have no report IDs, so don't advertise it.
+		desc := append(WithReportId(keyboardDesc, KEYBOARD_REPORT_ID), WithReportId(mouseDesc, MOUSE_REPORT_ID)...)
+		length := keyboardLength
+		if mouseLength > length {
+			length = mouseLength
+		}
+		if config.SetupConsumer {
+			desc = append(desc, WithReportId(ConsumerReportDescriptor, CONSUMER_REPORT_ID)...)
+		}
+		if config.SetupTablet {
+			desc = append(desc, WithReportId(TabletReportDescriptor, TABLET_REPORT_ID)...)
+		}
+		if config.SetupGamepad {
+			desc = append(desc, WithReportId(GamepadReportDescriptor, GAMEPAD_REPORT_ID)...)
+		}
+		if config.SetupDigitizer {
+			desc = append(desc, WithReportId(DigitizerReportDescriptor(config.MaxContacts), DIGITIZER_REPORT_ID)...)
+			if DigitizerReportLength(config.MaxContacts) > length {
+				length = DigitizerReportLength(config.MaxContacts)
+			}
+		}
+		addFunction("hid.usb0", 0, 0, length+1, desc)
+	} else {
+		addFunction("hid.usb0", 1, keyboardSubclass, keyboardLength, keyboardDesc)
+		addFunction("hid.usb1", 2, 1, mouseLength, mouseDesc)
+		if config.SetupConsumer {
+			addFunction("hid.usb2", 0, 0, 2, ConsumerReportDescriptor)
+		}
+		if config.SetupTablet {
+			addFunction("hid.usb3", 0, 0, 5, TabletReportDescriptor)
+		}
+		if config.SetupGamepad {
+			addFunction("hid.usb4", 0, 0, GAMEPAD_REPORT_LENGTH, GamepadReportDescriptor)
+		}
+		if config.SetupDigitizer {
+			addFunction("hid.usb5", 0, 0, DigitizerReportLength(config.MaxContacts), DigitizerReportDescriptor(config.MaxContacts))
+		}
+	}
+
+	checkExistingGadget("/sys/kernel/config/usb_gadget/piproxy", config.ReuseGadget, filesStr, filesBytes)
+
 	for _, path := range paths {
 		if _, err := os.Stat(path); os.IsNotExist(err) {
 			log.Debugf("Creating directory: %s", path)
@@ -243,15 +459,11 @@ func SetupUSBGadget() {
 
 	time.Sleep(1000 * time.Millisecond)
 
-	matches, err := filepath.Glob("/sys/class/udc/*")
+	udc, err := WaitForUdc(config.UdcName, time.Duration(config.UdcWaitTimeout)*time.Second)
 	if err != nil {
-		log.Fatalf("Failed to list files in /sys/class/udc: %s", err.Error())
+		log.Fatal(err)
 	}
 	var udcFile string = "/sys/kernel/config/usb_gadget/piproxy/UDC"
-	var udc string = ""
-	for _, match := range matches {
-		udc = udc + filepath.Base(match) + " "
-	}
 	content, err := ioutil.ReadFile(udcFile)
 	if err == nil {
 		if bytes.Compare(content[0:len(content)-1], []byte(strings.TrimSpace(udc))) != 0 {
@@ -265,25 +477,433 @@ func SetupUSBGadget() {
 	time.Sleep(1000 * time.Millisecond)
 }
 
-func HandleKeyboard(output chan<- error, input chan<- InputMessage, close <-chan bool, rate uint, delay uint, dev evdev.InputDevice) error {
-	keysDown := make([]uint16, 0)
-	err := dev.Grab()
+// Removes the USB gadget created by SetupUSBGadget, unbinding it from the UDC
+// first. Also used to clean up a gadget left over from a previous run.
+func TeardownUSBGadget() {
+	teardownGadget("/sys/kernel/config/usb_gadget/piproxy")
+}
+
+// Unbinds and removes the gadget at the configfs path
+func teardownGadget(gadget string) {
+	if _, err := os.Stat(gadget); os.IsNotExist(err) {
+		return
+	}
+
+	log.Info("Tearing down USB gadget...")
+	err := ioutil.WriteFile(gadget+"/UDC", []byte("\n"), os.FileMode(0644))
 	if err != nil {
-		log.Fatal(err)
-		output <- err
-		return err
+		log.Warnf("Failed to unbind gadget from UDC: %s", err.Error())
+	}
+
+	// Function links first, then directories from the leaves up
+	links, _ := filepath.Glob(gadget + "/configs/*/hid.*")
+	for _, link := range links {
+		log.Debugf("Removing symlink: %s", link)
+		if err := os.Remove(link); err != nil {
+			log.Warnf("Failed to remove symlink %s: %s", link, err.Error())
+		}
+	}
+	for _, pattern := range []string{"/configs/*/strings/*", "/configs/*", "/functions/*", "/strings/*", ""} {
+		dirs, _ := filepath.Glob(gadget + pattern)
+		for _, dir := range dirs {
+			log.Debugf("Removing directory: %s", dir)
+			if err := os.Remove(dir); err != nil {
+				log.Warnf("Failed to remove directory %s: %s", dir, err.Error())
+			}
+		}
+	}
+}
+
+// Maps a HID usage code to its bit in the modifier byte
+func ModifierBit(k uint16) (uint8, bool) {
+	switch {
+	case k == 224: // Left-Ctrl
+		return LEFT_CONTROL, true
+	case k == 227: // Left-Cmd
+		return LEFT_META, true
+	case k == 225: // Left-Shift
+		return LEFT_SHIFT, true
+	case k == 226: // Left-Alt
+		return LEFT_ALT, true
+	case k == 228: // Right-Ctrl
+		return RIGHT_CONTROL, true
+	case k == 231: // Right-Cmd
+		return RIGHT_META, true
+	case k == 229: // Right-Shift
+		return RIGHT_SHIFT, true
+	case k == 230: // Right-Alt
+		return RIGHT_ALT, true
+	}
+	return 0, false
+}
+
+// Builds an 8-byte boot protocol keyboard report (modifiers, reserved, 6 keys)
+// With more than 6 keys pressed all the key slots report ErrorRollOver.
+func KeyboardReport(keysDown []uint16) []uint8 {
+	var modifiers uint8 = 0
+	keysToSend := make([]uint8, 0)
+	for _, k := range keysDown {
+		if bit, ok := ModifierBit(k); ok {
+			modifiers |= bit
+		} else if k <= BOOT_KEYBOARD_MAX_USAGE {
+			keysToSend = append(keysToSend, uint8(k))
+		}
+	}
+	if len(keysToSend) > 6 {
+		keysToSend = bytes.Repeat([]uint8{KEY_ERROR_ROLLOVER}, 6)
+	}
+	keysToSend = append([]uint8{modifiers, 0}, keysToSend...)
+	if len(keysToSend) < 8 {
+		for i := len(keysToSend); i < 8; i++ {
+			keysToSend = append(keysToSend, uint8(0))
+		}
+	}
+	return keysToSend
+}
+
+// Builds an N-key rollover report (modifiers, one bit per usage code)
+func KeyboardReportNKRO(keysDown []uint16) []uint8 {
+	keysToSend := make([]uint8, NKRO_REPORT_LENGTH)
+	for _, k := range keysDown {
+		if bit, ok := ModifierBit(k); ok {
+			keysToSend[0] |= bit
+		} else if k < NKRO_KEYS {
+			keysToSend[1+k/8] |= 1 << (k % 8)
+		}
+	}
+	return keysToSend
+}
+
+// Tracks the pressed keys (HID usage codes) of a keyboard
+type KeyboardState struct {
+	NKRO     bool
+	keysDown []uint16
+}
+
+func (k *KeyboardState) Press(keyCode uint16) {
+	for _, key := range k.keysDown {
+		if key == keyCode {
+			return
+		}
+	}
+	k.keysDown = append(k.keysDown, keyCode)
+}
+
+func (k *KeyboardState) Release(keyCode uint16) {
+	newKeysDown := make([]uint16, 0)
+	for _, key := range k.keysDown {
+		if key != keyCode {
+			newKeysDown = append(newKeysDown, key)
+		}
+	}
+	k.keysDown = newKeysDown
+}
+
+func (k *KeyboardState) Pressed() bool {
+	return len(k.keysDown) > 0
+}
+
+func (k *KeyboardState) ReleaseAll() {
+	k.keysDown = make([]uint16, 0)
+}
+
+func (k *KeyboardState) Report() []uint8 {
+	if k.NKRO {
+		return KeyboardReportNKRO(k.keysDown)
+	}
+	return KeyboardReport(k.keysDown)
+}
+
+// Grabs the device for exclusive access, so its input doesn't also go to
+// the local console. Returns true if the device was grabbed.
+func GrabDevice(dev evdev.InputDevice) bool {
+	if err := dev.Grab(); err != nil {
+		log.Warnf("Failed to grab %s (%s), input also goes to the local system: %s", dev.Name, dev.Fn, err.Error())
+		return false
+	}
+	log.Infof("Grabbed %s (%s)", dev.Name, dev.Fn)
+	return true
+}
+
+// Keeps a device grabbed while input is forwarded. The grab is released
+// while forwarding is paused, so the device can be used locally meanwhile.
+type pauseGrab struct {
+	dev     evdev.InputDevice
+	grab    bool
+	grabbed bool
+	pause   *PauseState
+	changed <-chan struct{}
+}
+
+func newPauseGrab(dev evdev.InputDevice, grab bool, pause *PauseState) *pauseGrab {
+	g := &pauseGrab{dev: dev, grab: grab, pause: pause}
+	if pause != nil {
+		g.changed = pause.Changed()
+	}
+	if grab && (pause == nil || !pause.Paused()) {
+		g.grabbed = GrabDevice(dev)
+	}
+	return g
+}
+
+// Grabs or releases the device if forwarding was paused or resumed
+func (g *pauseGrab) check() {
+	select {
+	case <-g.changed:
+	default:
+		return
+	}
+	g.changed = g.pause.Changed()
+	if g.pause.Paused() && g.grabbed {
+		log.Infof("Releasing %s (%s) while forwarding is paused", g.dev.Name, g.dev.Fn)
+		g.dev.Release()
+		g.grabbed = false
+	} else if !g.pause.Paused() && g.grab && !g.grabbed {
+		g.grabbed = GrabDevice(g.dev)
+	}
+}
+
+func (g *pauseGrab) release() {
+	if g.grabbed {
+		g.dev.Release()
+	}
+}
+
+// KeyboardTranslator turns key events of a keyboard into keyboard and
+// consumer control reports. It doesn't read the device itself, so it can
+// be fed events without one. Keys are reported through the merged keyboard
+// shared by all keyboards.
+type KeyboardTranslator struct {
+	Keys      KeyboardState
+	Remap     map[uint16]uint16
+	Debouncer *Debouncer
+	Keyboard  *MergedKeyboard
+	Consumer  chan<- InputMessage
+	Device    evdev.InputDevice
+	// Pressing the hotkey toggles Pause, the last key of it isn't forwarded
+	Hotkey []uint16
+	Pause  *PauseState
+	// Trigger keys of macros are never forwarded
+	Macros *Macros
+	// Keys are remapped by the layer of the layer key held down
+	Layers Layers
+	// Keys are repeated by the proxy if set (SoftwareRepeat)
+	Repeat *KeyRepeater
+
+	consumerUsage uint16
+	// Keys held on the device before remapping, for the hotkey
+	held       map[uint16]bool
+	swallowing bool
+	// Keys held by the macro being played back
+	macroKeys  KeyboardState
+	macroQueue chan macroRun
+	// The layer key held down and the keys pressed in its layer
+	layer   uint16
+	layered map[uint16]uint16
+}
+
+func NewKeyboardTranslator(keyboard *MergedKeyboard, consumer chan<- InputMessage, remap map[uint16]uint16, debounce time.Duration, dev evdev.InputDevice) *KeyboardTranslator {
+	return &KeyboardTranslator{
+		Remap:     remap,
+		Debouncer: NewDebouncer(debounce),
+		Keyboard:  keyboard,
+		Consumer:  consumer,
+		Device:    dev,
+		held:      make(map[uint16]bool, 0),
+	}
+}
+
+// Watches for the toggle hotkey and returns true if the event is part of
+// it and shouldn't be forwarded
+func (t *KeyboardTranslator) toggleHotkey(code uint16, value int32) bool {
+	if len(t.Hotkey) == 0 || t.Pause == nil {
+		return false
+	}
+	trigger := t.Hotkey[len(t.Hotkey)-1]
+	if code != trigger {
+		if value == 1 {
+			t.held[code] = true
+		} else if value == 0 {
+			delete(t.held, code)
+		}
+		return false
 	}
-	defer dev.Release()
+	switch value {
+	case 1: // Key down
+		for _, key := range t.Hotkey[:len(t.Hotkey)-1] {
+			if !t.held[key] {
+				return false
+			}
+		}
+		t.swallowing = true
+		if t.Pause.Toggle() {
+			log.Infof("Toggle hotkey pressed on %s (%s), pausing forwarding of input", t.Device.Name, t.Device.Fn)
+		} else {
+			log.Infof("Toggle hotkey pressed on %s (%s), resuming forwarding of input", t.Device.Name, t.Device.Fn)
+		}
+		return true
+	case 2: // Autorepeat
+		return t.swallowing
+	}
+	swallowed := t.swallowing
+	t.swallowing = false
+	return swallowed
+}
+
+// Releases held keys and consumer controls, eg. when the device goes away
+func (t *KeyboardTranslator) ReleaseAll() {
+	if t.Keys.Pressed() {
+		log.Infof("Releasing keys held on %s (%s)", t.Device.Name, t.Device.Fn)
+		t.Keyboard.Update(&t.Keys, t.Keys.ReleaseAll)
+	}
+	t.layer, t.layered = 0, nil
+	t.Repeat.Stop()
+	if t.consumerUsage != 0 {
+		t.consumerUsage = 0
+		t.Consumer <- InputMessage{Timestamp: hrtime.Now(), Message: ConsumerReport(0)}
+	}
+}
+
+// Sends the repeat of the key held down if it is due
+func (t *KeyboardTranslator) Tick() {
+	key, ok := t.Repeat.Tick()
+	if !ok {
+		return
+	}
+	log.Debugf("Repeating key %d", key)
+	t.Keyboard.Repeat(key)
+}
+
+// Returns true while keys or consumer controls are held
+func (t *KeyboardTranslator) Held() bool {
+	return t.Keys.Pressed() || t.consumerUsage != 0 || t.layer != 0
+}
+
+func (t *KeyboardTranslator) Event(event *evdev.InputEvent) {
+	if event.Type != evdev.EV_KEY {
+		return
+	}
+	keyEvent := evdev.NewKeyEvent(event)
+	log.Debugf("Key event: scancode=%d, keycode=%d, state=%d", keyEvent.Scancode, keyEvent.Keycode, keyEvent.State)
+	at := time.Unix(int64(event.Time.Sec), int64(event.Time.Usec)*1000)
+	if !t.Debouncer.Accept(keyEvent.Scancode, event.Value, at) {
+		log.Debugf("Dropping bouncing key event: scancode=%d, state=%d", keyEvent.Scancode, keyEvent.State)
+		return
+	}
+	// Kernel autorepeat doesn't stop the repeat of the proxy
+	if keyEvent.State != 2 {
+		t.Repeat.Stop()
+	}
+	if t.toggleHotkey(keyEvent.Scancode, event.Value) || t.macro(keyEvent.Scancode, event.Value) || t.layerKey(keyEvent.Scancode, event.Value) {
+		return
+	}
+	if code, ok := t.layerCode(keyEvent.Scancode, event.Value); ok {
+		log.Debugf("Remapped scancode %d to %d in layer", keyEvent.Scancode, code)
+		keyEvent.Scancode = code
+	} else if code, ok := t.Remap[keyEvent.Scancode]; ok {
+		log.Debugf("Remapped scancode %d to %d", keyEvent.Scancode, code)
+		keyEvent.Scancode = code
+	}
+	if keyEvent.Scancode == 0 {
+		log.Debugf("Ignoring disabled key")
+	} else if usage, ok := ConsumerCodes[keyEvent.Scancode]; ok && t.Consumer != nil {
+		if keyEvent.State == 0 { // Key up
+			usage = 0
+		}
+		if keyEvent.State != 2 {
+			t.consumerUsage = usage
+			t.Consumer <- InputMessage{
+				Timestamp: hrtime.Now(),
+				Message:   ConsumerReport(usage),
+			}
+			LogEvent(t.Device, event, ConsumerReport(usage))
+			log.Debugf("Consumer status (scancode %d): 0x%04x\n", keyEvent.Scancode, usage)
+		}
+	} else if keyCode, ok := HidUsage(keyEvent.Scancode, t.Keyboard.NKRO()); ok {
+		keysToSend := t.Keyboard.Update(&t.Keys, func() {
+			if keyEvent.State == 1 { // Key down
+				t.Keys.Press(keyCode)
+				t.Repeat.Press(keyCode)
+			}
+			if keyEvent.State == 0 { // Key up
+				t.Keys.Release(keyCode)
+			}
+		})
+		LogEvent(t.Device, event, keysToSend)
 
-	log.Infof("Grabbed keyboard-like device: %s (%s)", dev.Name, dev.Fn)
+		log.Debugf("Key status (scancode %d, keycode %d): %v\n", keyEvent.Scancode, keyCode, keysToSend)
+	} else {
+		UnknownKeysCounter.Inc()
+		log.Debugf("Dropping key without a HID usage: scancode=%d", keyEvent.Scancode)
+	}
+}
+
+// Settings of the read loop of a single input device, the translation
+// itself is configured on the translator
+type DeviceOptions struct {
+	// Keyboard repeat period and delay (ms)
+	Rate  uint
+	Delay uint
+	// Repeat keys in the proxy instead of setting the kernel repeat
+	SoftwareRepeat bool
+	// Held keys and buttons are released after this long without events,
+	// disabled if zero
+	LinkTimeout time.Duration
+	// Grab the device, released while Pause is paused
+	Grab  bool
+	Pause *PauseState
+}
+
+// Reads the keyboard of the translator (its Device) until ctx is done or
+// the device goes away
+func HandleKeyboard(ctx context.Context, output chan<- error, translator *KeyboardTranslator, options DeviceOptions) error {
+	dev := translator.Device
+	rate, delay := options.Rate, options.Delay
+	watchdog := NewLinkWatchdog(options.LinkTimeout, dev)
+	defer dev.File.Close()
+	grabber := newPauseGrab(dev, options.Grab, options.Pause)
+	defer grabber.release()
+	// Release keys held when the device goes away, so they don't stay
+	// pressed on the host
+	defer translator.ReleaseAll()
+	// Macros stop before that, also when the device fails
+	macroCtx, stopMacros := context.WithCancel(ctx)
+	macrosDone := translator.PlayMacros(macroCtx)
+	defer func() {
+		stopMacros()
+		<-macrosDone
+	}()
+
+	log.Infof("Reading keyboard-like device: %s (%s)", dev.Name, dev.Fn)
 	syscall.SetNonblock(int(dev.File.Fd()), true)
 
-	log.Infof("Setting repeat rate to %d, delay %d for %s (%s)", rate, delay, dev.Name, dev.Fn)
-	dev.SetRepeatRate(rate, delay)
+	if options.SoftwareRepeat {
+		log.Infof("Repeating keys of %s (%s) in the proxy every %d ms after %d ms", dev.Name, dev.Fn, rate, delay)
+		translator.Repeat = NewKeyRepeater(time.Duration(delay)*time.Millisecond, time.Duration(rate)*time.Millisecond, SystemClock)
+	} else {
+		log.Infof("Setting kernel repeat (EVIOCSREP) to every %d ms after %d ms for %s (%s)", rate, delay, dev.Name, dev.Fn)
+		// Despite its argument names, SetRepeatRate passes them on as
+		// REP_DELAY and REP_PERIOD
+		dev.SetRepeatRate(delay, rate)
+	}
 
-	loop := 0
 	for {
-		err = dev.File.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		if ctx.Err() != nil {
+			log.Infof("Stopping processing keyboard input from: %s (%s)", dev.Name, dev.Fn)
+			output <- nil
+			return nil
+		}
+		grabber.check()
+		translator.Tick()
+
+		timeout := 250 * time.Millisecond
+		if due, ok := watchdog.Due(time.Now()); ok && translator.Held() && due < timeout {
+			timeout = due
+		}
+		if due, ok := translator.Repeat.Due(); ok && due < timeout {
+			timeout = due
+		}
+		err := dev.File.SetReadDeadline(time.Now().Add(timeout))
 		if err != nil {
 			log.Fatal(err)
 			output <- err
@@ -292,112 +912,393 @@ func HandleKeyboard(output chan<- error, input chan<- InputMessage, close <-chan
 
 		event, err := dev.ReadOne()
 		if err != nil && strings.Contains(err.Error(), "i/o timeout") {
+			if watchdog.Expired(translator.Held(), time.Now()) {
+				translator.ReleaseAll()
+			}
 			continue
 		}
 		if err != nil {
-			log.Fatal(err)
+			log.Errorf("Error reading from %s (%s): %s", dev.Name, dev.Fn, err.Error())
 			output <- err
 			return err
 		}
 		log.Debugf("Keyboard input event: type=%d, code=%d, value=%d", event.Type, event.Code, event.Value)
-		if event.Type == evdev.EV_KEY {
-			keyEvent := evdev.NewKeyEvent(event)
-			log.Debugf("Key event: scancode=%d, keycode=%d, state=%d", keyEvent.Scancode, keyEvent.Keycode, keyEvent.State)
-			if keyCode, ok := Scancodes[keyEvent.Scancode]; ok {
-				if keyEvent.State == 1 { // Key down
-					keyIsDown := false
-					for _, k := range keysDown {
-						if k == keyCode {
-							keyIsDown = true
-						}
-					}
-					if !keyIsDown {
-						keysDown = append(keysDown, keyCode)
-					}
-				}
-				if keyEvent.State == 0 { // Key up
-					newKeysDown := make([]uint16, 0)
-					for _, k := range keysDown {
-						if k != keyCode {
-							newKeysDown = append(newKeysDown, k)
-						}
-					}
-					keysDown = newKeysDown
-				}
+		watchdog.Event(event, time.Now())
+		translator.Event(event)
+	}
+}
 
-				var modifiers uint8 = 0
-				keysToSend := make([]uint8, 0)
-				for _, k := range keysDown {
-					switch {
-					case k == 224: // Left-Ctrl
-						modifiers |= LEFT_CONTROL
-					case k == 227: // Left-Cmd
-						modifiers |= LEFT_META
-					case k == 225: // Left-Shift
-						modifiers |= LEFT_SHIFT
-					case k == 226: // Left-Alt
-						modifiers |= LEFT_ALT
-					case k == 228: // Right-Ctrl
-						modifiers |= RIGHT_CONTROL
-					case k == 231: // Right-Cmd
-						modifiers |= RIGHT_META
-					case k == 229: // Right-Shift
-						modifiers |= RIGHT_SHIFT
-					case k == 230: // Right-Alt
-						modifiers |= RIGHT_ALT
-					default:
-						keysToSend = append(keysToSend, uint8(k))
-					}
-				}
-				keysToSend = append([]uint8{modifiers, 0}, keysToSend...)
-				if len(keysToSend) < 8 {
-					for i := len(keysToSend); i < 8; i++ {
-						keysToSend = append(keysToSend, uint8(0))
-					}
-				}
-				input <- InputMessage{
-					Timestamp: hrtime.Now(),
-					Message:   keysToSend,
-				}
+// Evdev button codes to mouse report button bits
+var MouseButtons = map[uint16]uint8{
+	272: BUTTON_LEFT,
+	273: BUTTON_RIGHT,
+	274: BUTTON_MIDDLE,
+}
 
-				log.Debugf("Key status (scancode %d, keycode %d): %v\n", keyEvent.Scancode, keyCode, keysToSend)
-			} else {
-				log.Warnf("Unknown scancode: %d\n", keyEvent.Scancode)
-			}
+// Back and forward thumb buttons, mapped to buttons 4 and 5 if
+// MouseExtraButtons is set. Boot protocol hosts only read the first three
+// button bits and ignore these.
+var MouseExtraButtons = map[uint16]uint8{
+	evdev.BTN_SIDE:    BUTTON_SIDE,
+	evdev.BTN_EXTRA:   BUTTON_EXTRA,
+	evdev.BTN_BACK:    BUTTON_SIDE,
+	evdev.BTN_FORWARD: BUTTON_EXTRA,
+}
+
+func SetButton(buttons uint8, bit uint8, down bool) uint8 {
+	if down {
+		return buttons | bit
+	}
+	return buttons & ^bit
+}
+
+// Builds a relative mouse report (buttons, X, Y, wheel). With high
+// resolution scrolling a horizontal pan byte is appended.
+func MouseReport(buttons uint8, x int32, y int32, wheel int32, pan int32, hires bool) []uint8 {
+	mouseToSend := []uint8{buttons, uint8(x), uint8(y), uint8(wheel)}
+	if hires {
+		mouseToSend = append(mouseToSend, uint8(pan))
+	}
+	return mouseToSend
+}
+
+// Converts REL_WHEEL_HI_RES style values (120 per detent) into wheel
+// units under the resolution multiplier, carrying over the remainder.
+type HiresScroll struct {
+	remainder int32
+}
+
+func (s *HiresScroll) Add(value int32) int32 {
+	s.remainder += value * MOUSE_WHEEL_MULTIPLIER
+	units := s.remainder / MOUSE_WHEEL_HI_RES_DETENT
+	s.remainder -= units * MOUSE_WHEEL_HI_RES_DETENT
+	return units
+}
+
+func hasCapability(dev evdev.InputDevice, evType int, code int) bool {
+	for k, codes := range dev.Capabilities {
+		if k.Type != evType {
+			continue
 		}
-		loop += 1
-		if loop > 3 {
-			select {
-			case _ = <-close:
-				log.Infof("Stopping processing keyboard input from: %s (%s)", dev.Name, dev.Fn)
-				output <- nil
-				return nil
-			default:
+		for _, c := range codes {
+			if c.Code == code {
+				return true
 			}
-			loop = 0
 		}
 	}
+	return false
+}
+
+// MouseTranslator turns button and relative motion events of a mouse into
+// mouse reports. Like KeyboardTranslator, it doesn't read the device.
+type MouseTranslator struct {
+	Hires   bool
+	Motion  *MouseMotion
+	Buttons map[uint16]uint8
+	Mouse   chan<- InputMessage
+	Device  evdev.InputDevice
+	// Motion is accumulated and sent at most once per Coalesce if set
+	Coalesce time.Duration
+	// Buttons of a chord pressed within ChordWindow send the chord button
+	Chords      []MouseChord
+	ChordWindow time.Duration
 
-	output <- nil
-	return nil
+	// Devices without high resolution wheel events only send REL_WHEEL/HWHEEL
+	hasHiresWheel bool
+	hasHiresPan   bool
+	hiresWheel    HiresScroll
+	hiresPan      HiresScroll
+	buttons       uint8
+
+	pendingX, pendingY, pendingWheel, pendingPan int32
+	lastEvent                                    *evdev.InputEvent
+	lastReport                                   time.Time
+
+	// Presses held back while waiting for the rest of a chord
+	chordPresses []*evdev.InputEvent
+	chordStart   time.Time
+	activeChord  *MouseChord
+	// Releases of chord buttons that are not sent on their own
+	chordSwallow map[uint16]bool
 }
 
-func HandleMouse(output chan<- error, input chan<- InputMessage, close <-chan bool, dev evdev.InputDevice) error {
-	err := dev.Grab()
-	if err != nil {
-		log.Fatal(err)
-		output <- err
-		return err
+func NewMouseTranslator(mouse chan<- InputMessage, hires bool, motion *MouseMotion, mouseButtons map[uint16]uint8, coalesce time.Duration, dev evdev.InputDevice) *MouseTranslator {
+	return &MouseTranslator{
+		Hires:         hires,
+		Motion:        motion,
+		Buttons:       mouseButtons,
+		Mouse:         mouse,
+		Device:        dev,
+		Coalesce:      coalesce,
+		hasHiresWheel: hasCapability(dev, evdev.EV_REL, REL_WHEEL_HI_RES),
+		hasHiresPan:   hasCapability(dev, evdev.EV_REL, REL_HWHEEL_HI_RES),
 	}
-	defer dev.Release()
+}
 
-	log.Infof("Grabbed mouse-like device: %s (%s)", dev.Name, dev.Fn)
+// Releases held buttons, eg. when the device goes away
+func (t *MouseTranslator) ReleaseAll() {
+	t.flushAll()
+	t.chordPresses, t.activeChord, t.chordSwallow = nil, nil, nil
+	if t.buttons != 0 {
+		log.Infof("Releasing buttons held on %s (%s)", t.Device.Name, t.Device.Fn)
+		t.buttons = 0
+		t.Mouse <- InputMessage{Timestamp: hrtime.Now(), Message: MouseReport(0, 0, 0, 0, 0, t.Hires)}
+	}
+}
+
+// Returns true while buttons are held or held back for a chord
+func (t *MouseTranslator) Held() bool {
+	return t.buttons != 0 || len(t.chordPresses) > 0
+}
+
+func (t *MouseTranslator) send(event *evdev.InputEvent, report []byte, motion bool) {
+	t.Mouse <- InputMessage{
+		Timestamp: hrtime.Now(),
+		Message:   report,
+		Motion:    motion,
+	}
+	LogEvent(t.Device, event, report)
+	t.lastReport = time.Now()
+}
+
+func (t *MouseTranslator) pending() bool {
+	return t.pendingX != 0 || t.pendingY != 0 || t.pendingWheel != 0 || t.pendingPan != 0
+}
+
+// Sends a report with the accumulated motion, or as much of it as fits
+// in one report. The rest stays pending.
+func (t *MouseTranslator) Flush() {
+	if !t.pending() {
+		return
+	}
+	x, y := ClampInt8(t.pendingX), ClampInt8(t.pendingY)
+	wheel, pan := ClampInt8(t.pendingWheel), ClampInt8(t.pendingPan)
+	t.pendingX, t.pendingY = t.pendingX-x, t.pendingY-y
+	t.pendingWheel, t.pendingPan = t.pendingWheel-wheel, t.pendingPan-pan
+	t.send(t.lastEvent, MouseReport(t.buttons, x, y, wheel, pan, t.Hires), true)
+}
+
+func (t *MouseTranslator) flushAll() {
+	for t.pending() {
+		t.Flush()
+	}
+}
+
+// Returns how long until the accumulated motion or the presses held back
+// for a chord are due to be sent, and false if there are none
+func (t *MouseTranslator) Due() (time.Duration, bool) {
+	var due time.Duration
+	ok := false
+	if t.pending() {
+		due, ok = t.Coalesce-time.Since(t.lastReport), true
+	}
+	if len(t.chordPresses) > 0 {
+		chordDue := t.ChordWindow - time.Since(t.chordStart)
+		if !ok || chordDue < due {
+			due, ok = chordDue, true
+		}
+	}
+	return due, ok
+}
+
+// Sends the accumulated motion and the presses held back for a chord if
+// they are due
+func (t *MouseTranslator) Tick() {
+	if due, ok := t.Due(); !ok || due > 0 {
+		return
+	}
+	if len(t.chordPresses) > 0 && time.Since(t.chordStart) >= t.ChordWindow {
+		t.flushChord()
+	}
+	if t.pending() && time.Since(t.lastReport) >= t.Coalesce {
+		t.Flush()
+	}
+}
+
+func (t *MouseTranslator) button(event *evdev.InputEvent) {
+	bit, ok := t.Buttons[event.Code]
+	if !ok {
+		return
+	}
+	// Buttons are never coalesced, and motion before the button goes first
+	t.flushAll()
+	t.buttons = SetButton(t.buttons, bit, event.Value > 0)
+	t.send(event, MouseReport(t.buttons, 0, 0, 0, 0, t.Hires), false)
+}
+
+// Sends the presses held back for a chord as normal presses
+func (t *MouseTranslator) flushChord() {
+	presses := t.chordPresses
+	t.chordPresses = nil
+	for _, press := range presses {
+		t.button(press)
+	}
+}
+
+// Returns true if the button can start or complete a chord. Chords with
+// another button already held down on its own can't.
+func (t *MouseTranslator) inChord(code uint16) bool {
+	for _, chord := range t.Chords {
+		if !chord.has(code) {
+			continue
+		}
+		held := false
+		for _, button := range chord.Buttons {
+			held = held || (button != code && t.buttons&t.Buttons[button] != 0)
+		}
+		if !held {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles the button event if it is part of a chord. Presses of chord
+// buttons are held back for the chord window: if the rest of the chord is
+// pressed in time, only the chord button is sent, otherwise the presses are
+// sent as they were. The chord button is released with the first chord
+// button, and the releases of the others are dropped.
+func (t *MouseTranslator) chordEvent(event *evdev.InputEvent) bool {
+	if len(t.Chords) == 0 || event.Value == 2 {
+		return false
+	}
+	code := event.Code
+	if event.Value == 0 {
+		if t.chordSwallow[code] {
+			delete(t.chordSwallow, code)
+			if t.activeChord != nil && t.activeChord.has(code) {
+				t.flushAll()
+				t.buttons = SetButton(t.buttons, t.activeChord.Bit, false)
+				t.send(event, MouseReport(t.buttons, 0, 0, 0, 0, t.Hires), false)
+				t.activeChord = nil
+			}
+			return true
+		}
+		for _, press := range t.chordPresses {
+			if press.Code == code {
+				// A normal click, too short for the rest of the chord
+				t.flushChord()
+				return false
+			}
+		}
+		return false
+	}
+	if t.activeChord != nil || !t.inChord(code) {
+		t.flushChord()
+		return false
+	}
+	if len(t.chordPresses) == 0 {
+		t.chordStart = time.Now()
+	}
+	t.chordPresses = append(t.chordPresses, event)
+	possible := false
+	for i := range t.Chords {
+		chord := &t.Chords[i]
+		complete, matches := true, true
+		for _, press := range t.chordPresses {
+			matches = matches && chord.has(press.Code)
+		}
+		for _, button := range chord.Buttons {
+			held := false
+			for _, press := range t.chordPresses {
+				held = held || press.Code == button
+			}
+			complete = complete && held
+		}
+		if matches && complete {
+			t.chordPresses = nil
+			t.activeChord = chord
+			t.chordSwallow = make(map[uint16]bool, len(chord.Buttons))
+			for _, button := range chord.Buttons {
+				t.chordSwallow[button] = true
+			}
+			t.flushAll()
+			t.buttons = SetButton(t.buttons, chord.Bit, true)
+			t.send(event, MouseReport(t.buttons, 0, 0, 0, 0, t.Hires), false)
+			return true
+		}
+		possible = possible || matches
+	}
+	if !possible {
+		t.flushChord()
+	}
+	return true
+}
+
+func (t *MouseTranslator) Event(event *evdev.InputEvent) {
+	if event.Type == evdev.EV_KEY {
+		if !t.chordEvent(event) {
+			t.button(event)
+		}
+		return
+	}
+	if event.Type != evdev.EV_REL {
+		return
+	}
+	var x, y, wheel, pan int32 = 0, 0, 0, 0
+	switch {
+	case event.Code == 0:
+		x = t.Motion.X(event.Value)
+	case event.Code == 1:
+		y = t.Motion.Y(event.Value)
+	case event.Code == evdev.REL_WHEEL && !t.Hires:
+		wheel = event.Value
+	// The report without hires has no pan field, so REL_HWHEEL is dropped
+	case event.Code == REL_WHEEL_HI_RES && t.Hires:
+		wheel = t.hiresWheel.Add(event.Value)
+	case event.Code == REL_HWHEEL_HI_RES && t.Hires:
+		pan = t.hiresPan.Add(event.Value)
+	// Only for devices without the hi-res codes, which would be counted twice
+	case event.Code == evdev.REL_WHEEL && t.Hires && !t.hasHiresWheel:
+		wheel = event.Value * MOUSE_WHEEL_MULTIPLIER
+	case event.Code == evdev.REL_HWHEEL && t.Hires && !t.hasHiresPan:
+		pan = event.Value * MOUSE_WHEEL_MULTIPLIER
+	}
+	wheel, pan = t.Motion.Scroll(wheel, pan)
+	if x == 0 && y == 0 && wheel == 0 && pan == 0 {
+		return
+	}
+	if t.Coalesce <= 0 {
+		t.send(event, MouseReport(t.buttons, x, y, wheel, pan, t.Hires), true)
+		return
+	}
+	t.pendingX, t.pendingY = t.pendingX+x, t.pendingY+y
+	t.pendingWheel, t.pendingPan = t.pendingWheel+wheel, t.pendingPan+pan
+	t.lastEvent = event
+	t.Tick()
+}
+
+// Reads the mouse of the translator (its Device) until ctx is done or the
+// device goes away. The repeat options don't apply to mice.
+func HandleMouse(ctx context.Context, output chan<- error, translator *MouseTranslator, options DeviceOptions) error {
+	dev := translator.Device
+	watchdog := NewLinkWatchdog(options.LinkTimeout, dev)
+	defer dev.File.Close()
+	grabber := newPauseGrab(dev, options.Grab, options.Pause)
+	defer grabber.release()
+	defer translator.ReleaseAll()
+
+	log.Infof("Reading mouse-like device: %s (%s)", dev.Name, dev.Fn)
 	syscall.SetNonblock(int(dev.File.Fd()), true)
 
-	loop := 0
-	var buttons uint8 = 0x0
 	for {
-		err = dev.File.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		if ctx.Err() != nil {
+			log.Infof("Stopping processing mouse input from: %s (%s)", dev.Name, dev.Fn)
+			output <- nil
+			return nil
+		}
+		grabber.check()
+
+		// Wake up in time to send coalesced motion and held back presses,
+		// and to release held buttons if the device goes silent
+		timeout := 250 * time.Millisecond
+		if due, ok := translator.Due(); ok && due < timeout {
+			timeout = due
+		}
+		if due, ok := watchdog.Due(time.Now()); ok && translator.Held() && due < timeout {
+			timeout = due
+		}
+		err := dev.File.SetReadDeadline(time.Now().Add(timeout))
 		if err != nil {
 			log.Fatal(err)
 			output <- err
@@ -406,159 +1307,295 @@ func HandleMouse(output chan<- error, input chan<- InputMessage, close <-chan bo
 
 		event, err := dev.ReadOne()
 		if err != nil && strings.Contains(err.Error(), "i/o timeout") {
+			translator.Tick()
+			if watchdog.Expired(translator.Held(), time.Now()) {
+				translator.ReleaseAll()
+			}
 			continue
 		}
 		if err != nil {
-			log.Fatal(err)
+			log.Errorf("Error reading from %s (%s): %s", dev.Name, dev.Fn, err.Error())
 			output <- err
 			return err
 		}
 		log.Debugf("Mouse input event: type=%d, code=%d, value=%d", event.Type, event.Code, event.Value)
-		var buttonOp bool = false
-		if event.Type == evdev.EV_KEY {
-			if event.Code == 272 {
-				if event.Value > 0 {
-					buttons |= BUTTON_LEFT
-				} else {
-					buttons &= ^uint8(BUTTON_LEFT)
-				}
-				buttonOp = true
-			}
-			if event.Code == 273 {
-				if event.Value > 0 {
-					buttons |= BUTTON_RIGHT
-				} else {
-					buttons &= ^uint8(BUTTON_RIGHT)
-				}
-				buttonOp = true
-			}
-			if event.Code == 274 {
-				if event.Value > 0 {
-					buttons |= BUTTON_MIDDLE
-				} else {
-					buttons &= ^uint8(BUTTON_MIDDLE)
-				}
-				buttonOp = true
-			}
-		}
-		if event.Type == evdev.EV_REL || buttonOp {
-			mouseToSend := make([]uint8, 0)
-			mouseToSend = append(mouseToSend, buttons)
-			if event.Type == evdev.EV_REL {
-				if event.Code == 0 {
-					mouseToSend = append(mouseToSend, uint8(event.Value))
-					mouseToSend = append(mouseToSend, 0x00)
-					mouseToSend = append(mouseToSend, 0x00)
-				}
-				if event.Code == 1 {
-					mouseToSend = append(mouseToSend, 0x00)
-					mouseToSend = append(mouseToSend, uint8(event.Value))
-					mouseToSend = append(mouseToSend, 0x00)
-				}
-				if event.Code == 11 {
-					mouseToSend = append(mouseToSend, 0x00)
-					mouseToSend = append(mouseToSend, 0x00)
-					mouseToSend = append(mouseToSend, uint8(event.Value))
-				}
-			} else {
-				mouseToSend = append(mouseToSend, 0x00)
-				mouseToSend = append(mouseToSend, 0x00)
-				mouseToSend = append(mouseToSend, 0x00)
-			}
-			input <- InputMessage{
-				Timestamp: hrtime.Now(),
-				Message:   mouseToSend,
-			}
-		}
-		loop += 1
-		if loop > 3 {
-			select {
-			case _ = <-close:
-				log.Infof("Stopping processing mouse input from: %s (%s)", dev.Name, dev.Fn)
-				output <- nil
-				return nil
-			default:
-			}
-			loop = 0
+		watchdog.Event(event, time.Now())
+		translator.Event(event)
+	}
+}
+
+// Where reports of one kind (keyboard, mouse, consumer) are written to
+type HidOutput struct {
+	Name     string
+	Path     string
+	ReportId uint8
+	Retries  int
+	Relative bool   // Only buttons are kept when resending the last report
+	Idle     []byte // Report releasing all keys, sent when pausing
+	Udc      *UdcMonitor
+	Pause    *PauseState
+	Power    *IdleMonitor
+	Latency  *LatencyStats // Only set if latency is measured
+	Recorder *Recorder     // Only set if reports are recorded
+	// Reports are sent to a receiver instead of the local gadget if set
+	RemoteNetwork string
+	RemoteAddr    string
+	Reports       *Counter
+	Errors        *Counter
+}
+
+// Returns the state in the last report, without any relative movement
+func (out HidOutput) currentState(last []byte) []byte {
+	report := append([]byte{}, last...)
+	if out.Relative {
+		for i := 1; i < len(report); i++ {
+			report[i] = 0
 		}
 	}
+	return report
+}
 
-	output <- nil
-	return nil
+// Returns the keyboard, mouse and consumer control outputs. In composite
+// mode all reports go to the same gadget, prefixed with a report ID.
+func HidOutputs(config Config) (HidOutput, HidOutput, HidOutput) {
+	keyboard := HidOutput{Name: "keyboard", Path: "/dev/hidg0", Reports: KeyboardReportsCounter, Errors: KeyboardWriteErrors}
+	mouse := HidOutput{Name: "mouse", Path: "/dev/hidg1", Reports: MouseReportsCounter, Errors: MouseWriteErrors}
+	consumer := HidOutput{Name: "consumer control", Path: "/dev/hidg2", Reports: ConsumerReportsCounter, Errors: ConsumerWriteErrors}
+	if config.CompositeGadget {
+		mouse.Path, consumer.Path = keyboard.Path, keyboard.Path
+		keyboard.ReportId, mouse.ReportId, consumer.ReportId = KEYBOARD_REPORT_ID, MOUSE_REPORT_ID, CONSUMER_REPORT_ID
+	}
+	keyboard.Retries, mouse.Retries, consumer.Retries = config.WriteRetries, config.WriteRetries, config.WriteRetries
+	mouse.Relative = true
+	keyboard.Idle = KeyboardReport([]uint16{})
+	if config.KeyboardNKRO {
+		keyboard.Idle = KeyboardReportNKRO([]uint16{})
+	}
+	mouse.Idle = MouseReport(0, 0, 0, 0, 0, config.MouseHiRes)
+	consumer.Idle = ConsumerReport(0)
+	keyboard.setOutputMode(config)
+	mouse.setOutputMode(config)
+	consumer.setOutputMode(config)
+	return keyboard, mouse, consumer
+}
 
+// Returns the absolute pointer output. Gadget nodes are numbered in the
+// order the functions are created, so it follows consumer control if enabled.
+func TabletOutput(config Config) HidOutput {
+	tablet := HidOutput{Name: "tablet", Path: "/dev/hidg2", Retries: config.WriteRetries, Reports: TabletReportsCounter, Errors: TabletWriteErrors}
+	if config.SetupConsumer {
+		tablet.Path = "/dev/hidg3"
+	}
+	if config.CompositeGadget {
+		tablet.Path, tablet.ReportId = "/dev/hidg0", TABLET_REPORT_ID
+	}
+	tablet.setOutputMode(config)
+	return tablet
 }
 
-func SendKeyboardReports(input <-chan InputMessage) error {
-	log.Info("Opening keyboard /dev/hidg0 for writing...")
-	file, err := os.OpenFile("/dev/hidg0", os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		log.Warn("Error opening /dev/hidg0, are you running as root?")
-		log.Fatal(err)
-		return err
+// Returns the gamepad output, which follows the consumer control and
+// tablet nodes if they are enabled.
+func GamepadOutput(config Config) HidOutput {
+	node := 2
+	if config.SetupConsumer {
+		node++
 	}
-	defer file.Close()
+	if config.SetupTablet {
+		node++
+	}
+	gamepad := HidOutput{Name: "gamepad", Path: "/dev/hidg" + strconv.Itoa(node), Retries: config.WriteRetries, Reports: GamepadReportsCounter, Errors: GamepadWriteErrors}
+	if config.CompositeGadget {
+		gamepad.Path, gamepad.ReportId = "/dev/hidg0", GAMEPAD_REPORT_ID
+	}
+	gamepad.setOutputMode(config)
+	return gamepad
+}
 
-	var avg, min, max, loop int64 = 0, 0, 0, 0
-	for {
-		msg := <-input
-		bytesWritten, err := file.Write(msg.Message)
-		if err != nil {
-			log.Fatal(err)
-			return err
+// Returns the multitouch digitizer output, the last gadget node
+func DigitizerOutput(config Config) HidOutput {
+	node := 2
+	if config.SetupConsumer {
+		node++
+	}
+	if config.SetupTablet {
+		node++
+	}
+	if config.SetupGamepad {
+		node++
+	}
+	digitizer := HidOutput{Name: "digitizer", Path: "/dev/hidg" + strconv.Itoa(node), Retries: config.WriteRetries, Reports: DigitizerReportsCounter, Errors: DigitizerWriteErrors}
+	if config.CompositeGadget {
+		digitizer.Path, digitizer.ReportId = "/dev/hidg0", DIGITIZER_REPORT_ID
+	}
+	digitizer.setOutputMode(config)
+	return digitizer
+}
+
+// Sends the reports of the output to a receiver in net output mode
+func (out *HidOutput) setOutputMode(config Config) {
+	if config.OutputMode == OUTPUT_NET {
+		out.RemoteNetwork, out.RemoteAddr = config.NetProtocol, config.RemoteAddr
+	}
+}
+
+// Reopens the sink with an increasing delay between attempts and resends
+// the report, which fails for example while the host is suspended.
+// Returns nil once the report is written, or the last error (the context's
+// if it is done) when the retries run out.
+func retryWrite(ctx context.Context, out HidOutput, sink ReportSink, report []byte) error {
+	delay := 100 * time.Millisecond
+	var err error
+	for attempt := 1; attempt <= out.Retries; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		latency := hrtime.Since(msg.Timestamp).Nanoseconds()
-		if latency < min {
-			min = latency
+		if delay < 5*time.Second {
+			delay *= 2
 		}
-		if latency > max {
-			max = latency
+
+		log.Infof("Reopening %s %s (attempt %d/%d)...", out.Name, out.Path, attempt, out.Retries)
+		err = sink.Reopen()
+		if err != nil {
+			log.Warnf("Error reopening %s: %s", out.Path, err.Error())
+			continue
 		}
-		avg = (avg + latency) / 2
-		loop += 1
-		if loop > 50 {
-			log.Debugf("Latency: now=%d, avg=%d, min=%d, max=%d μs", latency/1000, avg/1000, min/1000, max/1000)
-			loop = 0
+
+		err = sink.WriteReport(report)
+		if err == nil {
+			return nil
 		}
+		log.Warnf("Error writing to %s: %s", out.Path, err.Error())
+		out.Errors.Inc()
+	}
+	if out.Retries > 0 {
+		log.Errorf("Dropping report to %s after %d retries", out.Path, out.Retries)
+	}
+	return err
+}
 
-		log.Debugf("Wrote %d bytes to /dev/hidg0 (%v)", bytesWritten, msg)
+// Writes a report, prefixed with the report ID if any, retrying on errors
+func (out HidOutput) write(ctx context.Context, w HidWriter, message []byte) (int, error) {
+	report := message
+	if out.ReportId != 0 {
+		report = append([]byte{out.ReportId}, report...)
+	}
+	err := w.WriteReport(report)
+	if err != nil {
+		log.Errorf("Error writing to %s: %s", out.Path, err.Error())
+		out.Errors.Inc()
+		if sink, ok := w.(ReportSink); ok {
+			err = retryWrite(ctx, out, sink, report)
+		}
+	}
+	if err == nil && out.Recorder != nil {
+		out.Recorder.Record(out.Path, report)
 	}
-	return nil
+	return len(report), err
 }
 
-func SendMouseReports(input <-chan InputMessage) error {
-	log.Info("Opening keyboard /dev/hidg1 for writing...")
-	file, err := os.OpenFile("/dev/hidg1", os.O_APPEND|os.O_WRONLY, 0600)
+func SendReports(ctx context.Context, out HidOutput, input <-chan InputMessage) error {
+	if out.RemoteAddr != "" {
+		log.Infof("Opening %s %s on %s://%s for writing...", out.Name, out.Path, out.RemoteNetwork, out.RemoteAddr)
+	} else {
+		log.Infof("Opening %s %s for writing...", out.Name, out.Path)
+	}
+	sink, err := out.OpenSink()
 	if err != nil {
-		log.Warn("Error opening /dev/hidg1, are you running as root?")
-		log.Fatal(err)
+		log.Errorf("Error opening %s, are you running as root? %s", out.Path, err.Error())
 		return err
 	}
-	defer file.Close()
+	defer sink.Close()
+	return WriteReports(ctx, out, sink, input)
+}
 
-	var avg, min, max, loop int64 = 0, 0, 0, 0
+// Writes reports from input to w until the context is done
+func WriteReports(ctx context.Context, out HidOutput, w HidWriter, input <-chan InputMessage) error {
+	var resumed, pauseChanged <-chan struct{}
+	if out.Udc != nil {
+		resumed = out.Udc.Resumed()
+	}
+	if out.Pause != nil {
+		pauseChanged = out.Pause.Changed()
+	}
+	var slept <-chan struct{}
+	if out.Power != nil {
+		slept = out.Power.Slept()
+	}
+	// The sink is closed while the gadget is asleep
+	closed := false
+	var last []byte
 	for {
-		msg := <-input
-		bytesWritten, err := file.Write(msg.Message)
-		if err != nil {
-			log.Fatal(err)
-			return err
+		var msg InputMessage
+		select {
+		case msg = <-input:
+			if out.Power != nil {
+				out.Power.Wake()
+			}
+		case <-slept:
+			slept = out.Power.Slept()
+			if sink, ok := w.(ReportSink); ok {
+				sink.Close()
+				closed = true
+			}
+			continue
+		case <-resumed:
+			resumed = out.Udc.Resumed()
+			if last == nil {
+				continue
+			}
+			// Reports around the suspend were lost, so resend the current
+			// state to release keys and buttons released in the meantime
+			log.Infof("Host resumed, resending current state to %s", out.Path)
+			msg = InputMessage{Timestamp: hrtime.Now(), Message: out.currentState(last)}
+		case <-pauseChanged:
+			pauseChanged = out.Pause.Changed()
+			if out.Pause.Paused() {
+				// Release everything so nothing stays pressed while paused
+				if out.Idle != nil && last != nil && !closed {
+					out.write(ctx, w, out.Idle)
+				}
+				continue
+			}
+			if last == nil {
+				continue
+			}
+			msg = InputMessage{Timestamp: hrtime.Now(), Message: out.currentState(last)}
+		case <-ctx.Done():
+			return nil
 		}
-		log.Debugf("Wrote %d bytes to /dev/hidg1 (%v)", bytesWritten, msg)
-		latency := hrtime.Since(msg.Timestamp).Nanoseconds()
-		if latency < min {
-			min = latency
+		last = msg.Message
+		if closed && !out.Power.Asleep() {
+			// Reopened before writing the report that woke the gadget up
+			err := w.(ReportSink).Reopen()
+			if err != nil {
+				log.Warnf("Error reopening %s: %s", out.Path, err.Error())
+			}
+			closed = false
 		}
-		if latency > max {
-			max = latency
+		if closed {
+			log.Debugf("Gadget is asleep, dropping report to %s", out.Path)
+			continue
 		}
-		avg = (avg + latency) / 2
-		loop += 1
-		if loop > 100 {
-			log.Debugf("Latency: now=%d, avg=%d, min=%d, max=%d μs", latency/1000, avg/1000, min/1000, max/1000)
-			loop = 0
+		if out.Udc != nil && !out.Udc.Configured() {
+			log.Debugf("Host is suspended, dropping report to %s", out.Path)
+			continue
+		}
+		if out.Pause != nil && out.Pause.Paused() {
+			log.Debugf("Forwarding is paused, dropping report to %s", out.Path)
+			continue
+		}
+		bytesWritten, err := out.write(ctx, w, msg.Message)
+		if err != nil {
+			continue
+		}
+		out.Reports.Inc()
+		log.Debugf("Wrote %d bytes to %s (%v)", bytesWritten, out.Path, msg)
+		if out.Latency != nil {
+			out.Latency.Add(hrtime.Since(msg.Timestamp))
 		}
 	}
-	return nil
 }
 
 func GetDisconnectedDevices(adapterId string) ([]string, error) {
@@ -622,113 +1659,13 @@ func GetDisconnectedDevices(adapterId string) ([]string, error) {
 	return results, nil
 }
 
+// Start runs a proxy until SIGINT or SIGTERM, exiting on errors
 func Start(config Config) {
-	var wg sync.WaitGroup
-
-	log.SetLevel(config.LogLevel)
-
-	if config.SetupHid {
-		log.Info("Setting up HID files...")
-		SetupUSBGadget()
-	}
-
-	keyboardInput := make(chan InputMessage, 10)
-	mouseInput := make(chan InputMessage, 100)
-	output := make(map[InputDevice]chan error, 0)
-	close := make(map[InputDevice]chan bool, 0)
-
-	var udevCh <-chan *udev.Device
-	var cancel context.CancelFunc
-	var ctx context.Context
-
-	defer api.Exit()
-	u := udev.Udev{}
-	if config.MonitorUdev {
-		log.Info("Starting udev monitoring for Bluetooth devices")
-		m := u.NewMonitorFromNetlink("udev")
-		m.FilterAddMatchSubsystem("bluetooth")
-
-		ctx, cancel = context.WithCancel(context.Background())
-		udevCh, _ = m.DeviceChan(ctx)
+	proxy, err := New(config)
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	go SendKeyboardReports(keyboardInput)
-	go SendMouseReports(mouseInput)
-	wg.Add(1)
-	for {
-		select {
-		case d := <-udevCh:
-			if d.Action() == "add" || d.Action() == "remove" {
-				disconnected, err := GetDisconnectedDevices(config.AdapterId)
-				if err != nil {
-					log.Errorf("Error checking disconnected devices: %s", err.Error())
-				} else {
-					for _, device := range disconnected {
-						for devId, _ := range output {
-							if strings.HasPrefix(devId.Name, device) {
-								log.Infof("Disconnected device, stopping listening to: %s (%s)", devId.Name, devId.Device)
-								select {
-								case close[devId] <- true:
-									log.Infof("Sent stop signal to: %s (%s)", devId.Name, devId.Device)
-								default:
-								}
-
-							}
-						}
-					}
-				}
-			}
-		default:
-		}
-
-		log.Info("Polling for new devices in /dev/input\n")
-		devices, _ := evdev.ListInputDevices()
-		for _, dev := range devices {
-			isMouse := false
-			isKeyboard := false
-			for k := range dev.Capabilities {
-				if k.Name == "EV_REL" {
-					isMouse = true
-				}
-				if k.Name == "EV_KEY" {
-					isKeyboard = true
-				}
-			}
-			log.Debugf("Device %s (%s), capabilities: %v (mouse=%t, kbd=%t)", dev.Name, dev.Fn, dev.Capabilities, isMouse, isKeyboard)
-			if isKeyboard || isMouse {
-				devId := InputDevice{
-					Device: dev.Fn,
-					Name:   dev.Name,
-				}
-				if _, ok := output[devId]; !ok {
-					output[devId] = make(chan error, 10)
-					close[devId] = make(chan bool, 10)
-					if isKeyboard && !isMouse && config.SetupKeyboard {
-						go HandleKeyboard(output[devId], keyboardInput, close[devId], uint(config.KbdRepeat), uint(config.KbdDelay), *dev)
-						wg.Add(1)
-					}
-					log.Debugf("isKeyboard: %t, isMouse: %t, setupMouse: %t", !isKeyboard, isMouse, config.SetupMouse)
-					if isMouse && config.SetupMouse {
-						go HandleMouse(output[devId], mouseInput, close[devId], *dev)
-						wg.Add(1)
-					}
-				}
-			}
-		}
-		time.Sleep(1000 * time.Millisecond)
-		for id, eventOutput := range output {
-			select {
-			case msg := <-eventOutput:
-				if msg == nil {
-					log.Warnf("Event handler quit: %s", id.Device)
-				} else {
-					log.Errorf("Received error from %s: %s", id.Device, msg.Error())
-				}
-				delete(output, id)
-				wg.Done()
-			default:
-			}
-		}
+	if err := proxy.RunUntilSignal(); err != nil {
+		log.Fatal(err)
 	}
-	cancel()
 }
@@ -0,0 +1,160 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bytes"
+	evdev "github.com/gvalkov/golang-evdev"
+	"testing"
+)
+
+func keyEvent(code uint16, value int32) *evdev.InputEvent {
+	return &evdev.InputEvent{Type: evdev.EV_KEY, Code: code, Value: value}
+}
+
+// Returns the reports sent so far
+func drain(ch chan InputMessage) [][]byte {
+	reports := make([][]byte, 0)
+	for len(ch) > 0 {
+		reports = append(reports, (<-ch).Message)
+	}
+	return reports
+}
+
+func TestKeyboardReleaseAllOnDisconnect(t *testing.T) {
+	output := make(chan InputMessage, 10)
+	translator := NewKeyboardTranslator(NewMergedKeyboard(output, false), nil, nil, 0, evdev.InputDevice{})
+
+	translator.Event(keyEvent(evdev.KEY_A, 1))
+	reports := drain(output)
+	if len(reports) != 1 || !bytes.Equal(reports[0], []byte{0, 0, 4, 0, 0, 0, 0, 0}) {
+		t.Fatalf("unexpected reports for key press: %v", reports)
+	}
+
+	// The device goes away with the key held
+	translator.ReleaseAll()
+	reports = drain(output)
+	if len(reports) != 1 || !bytes.Equal(reports[0], make([]byte, 8)) {
+		t.Fatalf("expected an all-zero report after release, got %v", reports)
+	}
+
+	translator.ReleaseAll()
+	if reports = drain(output); len(reports) != 0 {
+		t.Fatalf("expected no reports with nothing held, got %v", reports)
+	}
+}
+
+func TestMouseReleaseAllOnDisconnect(t *testing.T) {
+	output := make(chan InputMessage, 10)
+	translator := NewMouseTranslator(output, false, NewMouseMotion(DefaultConfig()), MouseButtons, 0, evdev.InputDevice{})
+
+	translator.Event(keyEvent(evdev.BTN_LEFT, 1))
+	translator.Event(keyEvent(evdev.BTN_RIGHT, 1))
+	reports := drain(output)
+	if len(reports) != 2 || !bytes.Equal(reports[1], []byte{BUTTON_LEFT | BUTTON_RIGHT, 0, 0, 0}) {
+		t.Fatalf("unexpected reports for button presses: %v", reports)
+	}
+
+	translator.ReleaseAll()
+	reports = drain(output)
+	if len(reports) != 1 || !bytes.Equal(reports[0], make([]byte, 4)) {
+		t.Fatalf("expected an all-zero report after release, got %v", reports)
+	}
+
+	translator.ReleaseAll()
+	if reports = drain(output); len(reports) != 0 {
+		t.Fatalf("expected no reports with nothing held, got %v", reports)
+	}
+}
+
+func TestKeyboardReportRollover(t *testing.T) {
+	tests := []struct {
+		name     string
+		keys     []uint16
+		expected []byte
+	}{
+		{"six keys", []uint16{4, 5, 6, 7, 8, 9}, []byte{0, 0, 4, 5, 6, 7, 8, 9}},
+		{"seven keys", []uint16{4, 5, 6, 7, 8, 9, 10}, []byte{0, 0, 1, 1, 1, 1, 1, 1}},
+		{"modifiers kept", []uint16{225, 4, 5, 6, 7, 8, 9, 10, 224}, []byte{LEFT_SHIFT | LEFT_CONTROL, 0, 1, 1, 1, 1, 1, 1}},
+		{"modifiers don't count", []uint16{225, 224, 226, 4, 5, 6, 7, 8, 9}, []byte{LEFT_SHIFT | LEFT_CONTROL | LEFT_ALT, 0, 4, 5, 6, 7, 8, 9}},
+	}
+	for _, test := range tests {
+		if report := KeyboardReport(test.keys); !bytes.Equal(report, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, report)
+		}
+	}
+}
+
+func TestHighKeyCodesDropped(t *testing.T) {
+	tests := []struct {
+		name     string
+		nkro     bool
+		code     uint16
+		expected []byte // nil if the key is dropped
+	}{
+		{"boot key", false, evdev.KEY_A, []byte{0, 0, 4, 0, 0, 0, 0, 0}},
+		{"boot modifier", false, evdev.KEY_RIGHTSHIFT, []byte{RIGHT_SHIFT, 0, 0, 0, 0, 0, 0, 0}},
+		{"above boot maximum", false, evdev.KEY_MUTE, nil},
+		{"above nkro bitmap", false, evdev.KEY_PLAYPAUSE, nil},
+		{"nkro above boot maximum", true, evdev.KEY_MUTE, KeyboardReportNKRO([]uint16{127})},
+		{"nkro above bitmap", true, evdev.KEY_PLAYPAUSE, nil},
+		{"no usage", true, 0x2ff, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := make(chan InputMessage, 10)
+			translator := NewKeyboardTranslator(NewMergedKeyboard(output, test.nkro), nil, nil, 0, evdev.InputDevice{})
+			dropped := UnknownKeysCounter.Value()
+			translator.Event(keyEvent(test.code, 1))
+			translator.Event(keyEvent(test.code, 0))
+			reports := drain(output)
+			if test.expected == nil {
+				if len(reports) != 0 || UnknownKeysCounter.Value() != dropped+2 {
+					t.Fatalf("expected the key to be dropped and counted, got %v", reports)
+				}
+				return
+			}
+			if len(reports) != 2 || !bytes.Equal(reports[0], test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, reports)
+			}
+		})
+	}
+}
+
+func TestMouseWheelCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		hires    bool
+		events   []*evdev.InputEvent
+		expected [][]byte
+	}{
+		// Devices send both the legacy and the hi-res codes for each detent
+		{"legacy", false, []*evdev.InputEvent{relEvent(REL_WHEEL_HI_RES, 120), relEvent(evdev.REL_WHEEL, 1)}, [][]byte{{0, 0, 0, 1}}},
+		{"legacy pan", false, []*evdev.InputEvent{relEvent(REL_HWHEEL_HI_RES, 120), relEvent(evdev.REL_HWHEEL, 1)}, [][]byte{}},
+		{"hires", true, []*evdev.InputEvent{relEvent(REL_WHEEL_HI_RES, 120), relEvent(evdev.REL_WHEEL, 1)}, [][]byte{{0, 0, 0, MOUSE_WHEEL_MULTIPLIER, 0}}},
+		{"hires pan", true, []*evdev.InputEvent{relEvent(REL_HWHEEL_HI_RES, -120), relEvent(evdev.REL_HWHEEL, -1)}, [][]byte{{0, 0, 0, 0, uint8(256 - MOUSE_WHEEL_MULTIPLIER)}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := make(chan InputMessage, 10)
+			dev := evdev.InputDevice{Capabilities: map[evdev.CapabilityType][]evdev.CapabilityCode{
+				{Type: evdev.EV_REL}: {{Code: evdev.REL_WHEEL}, {Code: evdev.REL_HWHEEL}, {Code: REL_WHEEL_HI_RES}, {Code: REL_HWHEEL_HI_RES}},
+			}}
+			translator := NewMouseTranslator(output, test.hires, NewMouseMotion(DefaultConfig()), MouseButtons, 0, dev)
+			for _, event := range test.events {
+				translator.Event(event)
+			}
+			reports := drain(output)
+			if len(reports) != len(test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, reports)
+			}
+			for i := range reports {
+				if !bytes.Equal(reports[i], test.expected[i]) {
+					t.Fatalf("expected %v, got %v", test.expected, reports)
+				}
+			}
+		})
+	}
+}
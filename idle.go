@@ -0,0 +1,162 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdleMonitor puts the gadget to sleep when no reports have been sent for
+// the timeout, either by unbinding it from the UDC or by just closing the
+// gadget files. The next report wakes it up again.
+type IdleMonitor struct {
+	Timeout time.Duration
+	Unbind  bool
+	// Marked configured after rebinding, so the first report isn't dropped
+	Udc *UdcMonitor
+
+	mu     sync.Mutex
+	last   time.Time
+	asleep bool
+	udc    string
+	slept  chan struct{}
+	woken  chan struct{}
+	// Closed when the wake up in progress is done, nil if there is none
+	waking chan struct{}
+}
+
+func NewIdleMonitor(timeout time.Duration, unbind bool, udc *UdcMonitor) *IdleMonitor {
+	return &IdleMonitor{
+		Timeout: timeout,
+		Unbind:  unbind,
+		Udc:     udc,
+		last:    time.Now(),
+		slept:   make(chan struct{}),
+		woken:   make(chan struct{}),
+	}
+}
+
+func (m *IdleMonitor) Asleep() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.asleep
+}
+
+// Returns a channel that is closed when the gadget next goes to sleep
+func (m *IdleMonitor) Slept() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.slept
+}
+
+// Returns a channel that is closed when the gadget next wakes up
+func (m *IdleMonitor) Woken() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.woken
+}
+
+func (m *IdleMonitor) sleep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.asleep || m.waking != nil || time.Since(m.last) < m.Timeout {
+		return
+	}
+	if m.Unbind {
+		log.Infof("No input for %s, unbinding gadget from UDC", m.Timeout)
+		m.udc = udcName()
+		err := ioutil.WriteFile("/sys/kernel/config/usb_gadget/piproxy/UDC", []byte("\n"), os.FileMode(0644))
+		if err != nil {
+			log.Warnf("Failed to unbind gadget from UDC: %s", err.Error())
+			m.last = time.Now()
+			return
+		}
+	} else {
+		log.Infof("No input for %s, closing HID gadget files", m.Timeout)
+	}
+	m.asleep = true
+	close(m.slept)
+	m.slept = make(chan struct{})
+}
+
+// Records activity and wakes the gadget up if it is asleep. When the
+// gadget was unbound, this waits for the host to configure it again, so
+// the report that woke it up can be written right after. Writers waking
+// it up at the same time wait for the same wake up, without holding the
+// lock, so Asleep and the other calls don't block meanwhile.
+func (m *IdleMonitor) Wake() {
+	m.mu.Lock()
+	m.last = time.Now()
+	if !m.asleep {
+		m.mu.Unlock()
+		return
+	}
+	if waking := m.waking; waking != nil {
+		m.mu.Unlock()
+		<-waking
+		return
+	}
+	waking := make(chan struct{})
+	m.waking = waking
+	udc := m.udc
+	m.mu.Unlock()
+
+	if m.Unbind && udc != "" {
+		log.Infof("Input received, binding gadget to UDC %s", udc)
+		err := ioutil.WriteFile("/sys/kernel/config/usb_gadget/piproxy/UDC", []byte(udc), os.FileMode(0644))
+		if err != nil {
+			log.Warnf("Failed to bind gadget to UDC %s: %s", udc, err.Error())
+		}
+		// Otherwise the UDC monitor picks up the state once it changes
+		if waitConfigured(udc, 5*time.Second) && m.Udc != nil {
+			m.Udc.setState(UDC_CONFIGURED)
+		}
+	} else {
+		log.Info("Input received, reopening HID gadget files")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.asleep = false
+	m.waking = nil
+	close(waking)
+	close(m.woken)
+	m.woken = make(chan struct{})
+}
+
+// Waits until the host has configured the gadget on the UDC
+func waitConfigured(udc string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		content, err := ioutil.ReadFile(filepath.Join("/sys/class/udc", udc, "state"))
+		if err == nil && strings.TrimSpace(string(content)) == UDC_CONFIGURED {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	log.Warnf("Host didn't configure the gadget within %s", timeout)
+	return false
+}
+
+// Checks for idleness until the context is cancelled
+func (m *IdleMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.sleep()
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdleWake(t *testing.T) {
+	m := NewIdleMonitor(time.Minute, false, nil)
+	m.asleep = true
+	woken := m.Woken()
+
+	var wakes sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wakes.Add(1)
+		go func() {
+			defer wakes.Done()
+			m.Wake()
+			if m.Asleep() {
+				t.Errorf("asleep after Wake returned")
+			}
+		}()
+	}
+	wakes.Wait()
+
+	select {
+	case <-woken:
+	default:
+		t.Fatal("expected the woken channel to be closed")
+	}
+	select {
+	case <-m.Woken():
+		t.Fatal("expected a new woken channel after waking up")
+	default:
+	}
+}
@@ -0,0 +1,120 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	"strings"
+)
+
+// Evdev key names (KEY_A, KEY_LEFTCTRL, ...) to key codes
+var KeyCodes = map[string]uint16{}
+
+func init() {
+	for code, name := range evdev.KEY {
+		KeyCodes[name] = uint16(code)
+	}
+}
+
+func KeyCode(name string) (uint16, bool) {
+	code, ok := KeyCodes[strings.ToUpper(strings.TrimSpace(name))]
+	return code, ok
+}
+
+// ParseHotkey parses a key combination of evdev key names joined with "+",
+// eg. KEY_LEFTCTRL+KEY_LEFTALT+KEY_PAUSE. The last key triggers the hotkey
+// while the others are held. An empty string disables the hotkey.
+func ParseHotkey(hotkey string) ([]uint16, error) {
+	codes := make([]uint16, 0)
+	if strings.TrimSpace(hotkey) == "" {
+		return codes, nil
+	}
+	for _, name := range strings.Split(hotkey, "+") {
+		code, ok := KeyCode(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown key in hotkey %q: %s", hotkey, name)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// ParseKeyRemap validates a remap table of evdev key names and returns it
+// as evdev key codes. Keys remapped to an empty string (or KEY_RESERVED)
+// map to code 0, which disables them.
+func ParseKeyRemap(remap map[string]string) (map[uint16]uint16, error) {
+	codes := make(map[uint16]uint16, len(remap))
+	for from, to := range remap {
+		fromCode, ok := KeyCode(from)
+		if !ok {
+			return nil, fmt.Errorf("unknown key name in key remap: %s", from)
+		}
+		var toCode uint16 = 0
+		if strings.TrimSpace(to) != "" {
+			toCode, ok = KeyCode(to)
+			if !ok {
+				return nil, fmt.Errorf("unknown key name in key remap: %s", to)
+			}
+		}
+		codes[fromCode] = toCode
+	}
+	return codes, nil
+}
+
+// KeyStroke is a key, and whether shift is needed, that produces a character
+type KeyStroke struct {
+	Code  uint16
+	Shift bool
+}
+
+// Characters produced by the keys of a US layout, unshifted and shifted
+var usLayoutKeys = map[string][2]rune{
+	"KEY_GRAVE": {'`', '~'}, "KEY_1": {'1', '!'}, "KEY_2": {'2', '@'},
+	"KEY_3": {'3', '#'}, "KEY_4": {'4', '$'}, "KEY_5": {'5', '%'},
+	"KEY_6": {'6', '^'}, "KEY_7": {'7', '&'}, "KEY_8": {'8', '*'},
+	"KEY_9": {'9', '('}, "KEY_0": {'0', ')'}, "KEY_MINUS": {'-', '_'},
+	"KEY_EQUAL": {'=', '+'}, "KEY_LEFTBRACE": {'[', '{'}, "KEY_RIGHTBRACE": {']', '}'},
+	"KEY_BACKSLASH": {'\\', '|'}, "KEY_SEMICOLON": {';', ':'}, "KEY_APOSTROPHE": {'\'', '"'},
+	"KEY_COMMA": {',', '<'}, "KEY_DOT": {'.', '>'}, "KEY_SLASH": {'/', '?'},
+}
+
+// Characters to key strokes for the US layout
+var USKeymap = map[rune]KeyStroke{
+	' ':  {Code: evdev.KEY_SPACE},
+	'\t': {Code: evdev.KEY_TAB},
+	'\n': {Code: evdev.KEY_ENTER},
+}
+
+func init() {
+	for c := 'a'; c <= 'z'; c++ {
+		code := KeyCodes["KEY_"+strings.ToUpper(string(c))]
+		USKeymap[c] = KeyStroke{Code: code}
+		USKeymap[c-'a'+'A'] = KeyStroke{Code: code, Shift: true}
+	}
+	for name, chars := range usLayoutKeys {
+		USKeymap[chars[0]] = KeyStroke{Code: KeyCodes[name]}
+		USKeymap[chars[1]] = KeyStroke{Code: KeyCodes[name], Shift: true}
+	}
+}
+
+// KeyStrokes maps a string to key strokes, returning an error listing
+// every character that can't be typed with the keymap.
+func KeyStrokes(keymap map[rune]KeyStroke, s string) ([]KeyStroke, error) {
+	strokes := make([]KeyStroke, 0, len(s))
+	unmapped := make([]string, 0)
+	for _, r := range s {
+		stroke, ok := keymap[r]
+		if !ok {
+			unmapped = append(unmapped, fmt.Sprintf("%q (U+%04X)", r, r))
+			continue
+		}
+		strokes = append(strokes, stroke)
+	}
+	if len(unmapped) > 0 {
+		return nil, fmt.Errorf("characters not available in keyboard layout: %s", strings.Join(unmapped, ", "))
+	}
+	return strokes, nil
+}
@@ -0,0 +1,120 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of recent samples the minimum, maximum and percentiles are
+// calculated from
+const LATENCY_WINDOW = 1024
+
+// LatencyStats collects the time from reading an input event to the
+// resulting HID report being written
+type LatencyStats struct {
+	Report string
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	count   uint64
+	sum     time.Duration
+}
+
+type LatencySummary struct {
+	Count uint64
+	Sum   time.Duration
+	Min   time.Duration
+	Avg   time.Duration
+	Max   time.Duration
+	P99   time.Duration
+}
+
+var latencyMutex sync.Mutex
+var registeredLatencies = make([]*LatencyStats, 0)
+
+// Creates and registers latency stats for reports of a kind
+func NewLatencyStats(report string) *LatencyStats {
+	l := &LatencyStats{Report: report, samples: make([]time.Duration, 0, LATENCY_WINDOW)}
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	registeredLatencies = append(registeredLatencies, l)
+	return l
+}
+
+var (
+	KeyboardLatency  = NewLatencyStats("keyboard")
+	MouseLatency     = NewLatencyStats("mouse")
+	ConsumerLatency  = NewLatencyStats("consumer")
+	TabletLatency    = NewLatencyStats("tablet")
+	GamepadLatency   = NewLatencyStats("gamepad")
+	DigitizerLatency = NewLatencyStats("digitizer")
+)
+
+func (l *LatencyStats) Add(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.samples) < LATENCY_WINDOW {
+		l.samples = append(l.samples, latency)
+	} else {
+		l.samples[l.next] = latency
+	}
+	l.next = (l.next + 1) % LATENCY_WINDOW
+	l.count++
+	l.sum += latency
+}
+
+// Summary returns the total count and sum, and the minimum, average,
+// maximum and 99th percentile of the recent samples
+func (l *LatencyStats) Summary() LatencySummary {
+	l.mu.Lock()
+	summary := LatencySummary{Count: l.count, Sum: l.sum}
+	samples := append([]time.Duration{}, l.samples...)
+	l.mu.Unlock()
+
+	if len(samples) == 0 {
+		return summary
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var total time.Duration = 0
+	for _, sample := range samples {
+		total += sample
+	}
+	summary.Min = samples[0]
+	summary.Max = samples[len(samples)-1]
+	summary.Avg = total / time.Duration(len(samples))
+	summary.P99 = samples[(len(samples)-1)*99/100]
+	return summary
+}
+
+// Logs the latency of each kind of report that was written in the interval
+func LogLatency(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	counts := make(map[*LatencyStats]uint64, 0)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		latencyMutex.Lock()
+		stats := append([]*LatencyStats{}, registeredLatencies...)
+		latencyMutex.Unlock()
+		for _, l := range stats {
+			s := l.Summary()
+			if s.Count == counts[l] {
+				continue
+			}
+			counts[l] = s.Count
+			log.Infof("Latency of %s reports: min=%s, avg=%s, max=%s, p99=%s (%d reports)", l.Report, s.Min, s.Avg, s.Max, s.P99, s.Count)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// Layers maps a layer key to the key remap active while it is held
+type Layers map[uint16]map[uint16]uint16
+
+// ParseLayers parses layers by evdev key name, each a layer key with a key
+// remap like key-remap
+func ParseLayers(layers map[string]map[string]string) (Layers, error) {
+	parsed := make(Layers, len(layers))
+	for key, remap := range layers {
+		code, ok := KeyCode(key)
+		if !ok {
+			return nil, fmt.Errorf("unknown layer key: %s", key)
+		}
+		codes, err := ParseKeyRemap(remap)
+		if err != nil {
+			return nil, fmt.Errorf("invalid layer %s: %w", key, err)
+		}
+		parsed[code] = codes
+	}
+	return parsed, nil
+}
+
+// Tracks the layer keys, returning true if the event is for one. Layer
+// keys are never forwarded.
+func (t *KeyboardTranslator) layerKey(code uint16, value int32) bool {
+	if _, ok := t.Layers[code]; !ok {
+		return false
+	}
+	if value == 1 {
+		log.Debugf("Entering layer of scancode %d", code)
+		t.layer = code
+	} else if value == 0 && t.layer == code {
+		log.Debugf("Leaving layer of scancode %d", code)
+		t.layer = 0
+	}
+	return true
+}
+
+// Returns the key a scancode is remapped to by the active layer. Keys
+// pressed in a layer stay remapped until they are released, even if the
+// layer key is released first, and keys pressed before entering a layer
+// keep their base mapping.
+func (t *KeyboardTranslator) layerCode(code uint16, value int32) (uint16, bool) {
+	if target, ok := t.layered[code]; ok {
+		if value == 0 {
+			delete(t.layered, code)
+		}
+		return target, true
+	}
+	if value != 1 || t.layer == 0 {
+		return 0, false
+	}
+	target, ok := t.Layers[t.layer][code]
+	if !ok {
+		return 0, false
+	}
+	if t.layered == nil {
+		t.layered = make(map[uint16]uint16, 0)
+	}
+	t.layered[code] = target
+	return target, true
+}
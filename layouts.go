@@ -0,0 +1,107 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	"strings"
+)
+
+// Keyboard layouts as translations of physical (QWERTY) keys to the keys
+// a US QWERTY host needs to produce the layout's characters. Add new
+// layouts here.
+var Layouts = map[string]map[uint16]uint16{
+	"qwerty": {},
+	"dvorak": {
+		evdev.KEY_MINUS: evdev.KEY_LEFTBRACE,
+		evdev.KEY_EQUAL: evdev.KEY_RIGHTBRACE,
+
+		evdev.KEY_Q:          evdev.KEY_APOSTROPHE,
+		evdev.KEY_W:          evdev.KEY_COMMA,
+		evdev.KEY_E:          evdev.KEY_DOT,
+		evdev.KEY_R:          evdev.KEY_P,
+		evdev.KEY_T:          evdev.KEY_Y,
+		evdev.KEY_Y:          evdev.KEY_F,
+		evdev.KEY_U:          evdev.KEY_G,
+		evdev.KEY_I:          evdev.KEY_C,
+		evdev.KEY_O:          evdev.KEY_R,
+		evdev.KEY_P:          evdev.KEY_L,
+		evdev.KEY_LEFTBRACE:  evdev.KEY_SLASH,
+		evdev.KEY_RIGHTBRACE: evdev.KEY_EQUAL,
+
+		evdev.KEY_S:          evdev.KEY_O,
+		evdev.KEY_D:          evdev.KEY_E,
+		evdev.KEY_F:          evdev.KEY_U,
+		evdev.KEY_G:          evdev.KEY_I,
+		evdev.KEY_H:          evdev.KEY_D,
+		evdev.KEY_J:          evdev.KEY_H,
+		evdev.KEY_K:          evdev.KEY_T,
+		evdev.KEY_L:          evdev.KEY_N,
+		evdev.KEY_SEMICOLON:  evdev.KEY_S,
+		evdev.KEY_APOSTROPHE: evdev.KEY_MINUS,
+
+		evdev.KEY_Z:     evdev.KEY_SEMICOLON,
+		evdev.KEY_X:     evdev.KEY_Q,
+		evdev.KEY_C:     evdev.KEY_J,
+		evdev.KEY_V:     evdev.KEY_K,
+		evdev.KEY_B:     evdev.KEY_X,
+		evdev.KEY_N:     evdev.KEY_B,
+		evdev.KEY_COMMA: evdev.KEY_W,
+		evdev.KEY_DOT:   evdev.KEY_V,
+		evdev.KEY_SLASH: evdev.KEY_Z,
+	},
+	"colemak": {
+		evdev.KEY_E: evdev.KEY_F,
+		evdev.KEY_R: evdev.KEY_P,
+		evdev.KEY_T: evdev.KEY_G,
+		evdev.KEY_Y: evdev.KEY_J,
+		evdev.KEY_U: evdev.KEY_L,
+		evdev.KEY_I: evdev.KEY_U,
+		evdev.KEY_O: evdev.KEY_Y,
+		evdev.KEY_P: evdev.KEY_SEMICOLON,
+
+		evdev.KEY_S:         evdev.KEY_R,
+		evdev.KEY_D:         evdev.KEY_S,
+		evdev.KEY_F:         evdev.KEY_T,
+		evdev.KEY_G:         evdev.KEY_D,
+		evdev.KEY_J:         evdev.KEY_N,
+		evdev.KEY_K:         evdev.KEY_E,
+		evdev.KEY_L:         evdev.KEY_I,
+		evdev.KEY_SEMICOLON: evdev.KEY_O,
+
+		evdev.KEY_N: evdev.KEY_K,
+	},
+}
+
+// Returns the key translation table for the layout and key remaps of
+// the config
+func ConfigKeyRemap(config Config) (map[uint16]uint16, error) {
+	remap, err := ParseKeyRemap(config.KeyRemap)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key remap: %w", err)
+	}
+	return LayoutKeyRemap(config.Layout, remap)
+}
+
+// LayoutKeyRemap returns the key translation table of a layout combined
+// with the individual key remaps, which take precedence.
+func LayoutKeyRemap(layout string, remap map[uint16]uint16) (map[uint16]uint16, error) {
+	if layout == "" {
+		layout = "qwerty"
+	}
+	table, ok := Layouts[strings.ToLower(layout)]
+	if !ok {
+		return nil, fmt.Errorf("unknown keyboard layout: %s", layout)
+	}
+	codes := make(map[uint16]uint16, len(table)+len(remap))
+	for from, to := range table {
+		codes[from] = to
+	}
+	for from, to := range remap {
+		codes[from] = to
+	}
+	return codes, nil
+}
@@ -0,0 +1,144 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	LED_NUMLOCK    = 1 << 0
+	LED_CAPSLOCK   = 1 << 1
+	LED_SCROLLLOCK = 1 << 2
+)
+
+// LedSync forwards the LED state written by the USB host back to all the
+// keyboards, so their indicators match whichever keyboard toggled them.
+type LedSync struct {
+	mu      sync.Mutex
+	devices map[InputDevice]*os.File
+	// Last state from the host, applied to keyboards when they (re)connect
+	state uint8
+	known bool
+}
+
+func NewLedSync() *LedSync {
+	return &LedSync{
+		devices: make(map[InputDevice]*os.File, 0),
+	}
+}
+
+// Add opens the evdev node of a keyboard for writing LED events and sets
+// its LEDs to the last known state. The handle used for reading events is
+// read-only.
+func (l *LedSync) Add(devId InputDevice) error {
+	file, err := os.OpenFile(devId.Device, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if old, ok := l.devices[devId]; ok {
+		old.Close()
+	}
+	l.devices[devId] = file
+	if l.known {
+		l.write(devId, file, l.state)
+	}
+	return nil
+}
+
+func (l *LedSync) Remove(devId InputDevice) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if file, ok := l.devices[devId]; ok {
+		file.Close()
+		delete(l.devices, devId)
+	}
+}
+
+// Returns the last LED state from the host, if any has been received
+func (l *LedSync) State() (uint8, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state, l.known
+}
+
+func (l *LedSync) write(devId InputDevice, file *os.File, leds uint8) {
+	events := []evdev.InputEvent{
+		{Type: evdev.EV_LED, Code: evdev.LED_NUML, Value: int32(leds & LED_NUMLOCK)},
+		{Type: evdev.EV_LED, Code: evdev.LED_CAPSL, Value: int32((leds & LED_CAPSLOCK) >> 1)},
+		{Type: evdev.EV_LED, Code: evdev.LED_SCROLLL, Value: int32((leds & LED_SCROLLLOCK) >> 2)},
+		{Type: evdev.EV_SYN, Code: evdev.SYN_REPORT, Value: 0},
+	}
+	err := binary.Write(file, binary.LittleEndian, events)
+	if err != nil {
+		log.Warnf("Failed to set LEDs on %s (%s): %s", devId.Name, devId.Device, err.Error())
+		return
+	}
+	log.Debugf("Set LEDs to 0x%02x on %s (%s)", leds, devId.Name, devId.Device)
+}
+
+// Set writes the LED bitmask to every registered keyboard.
+func (l *LedSync) Set(leds uint8) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state, l.known = leds, true
+	for devId, file := range l.devices {
+		l.write(devId, file, leds)
+	}
+}
+
+// ReadKeyboardLeds reads LED output reports from the keyboard HID gadget
+// file and forwards them to all the keyboards. Returns when the file is closed,
+// which happens when the context is cancelled.
+func ReadKeyboardLeds(ctx context.Context, out HidOutput, leds *LedSync) error {
+	path := out.Path
+	log.Infof("Opening keyboard %s for reading LED state...", path)
+	file, err := os.OpenFile(path, os.O_RDONLY, 0600)
+	if err != nil {
+		log.Warnf("Error opening %s for reading: %s", path, err.Error())
+		return err
+	}
+	defer file.Close()
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+
+	report := make([]byte, 2)
+	for {
+		n, err := file.Read(report)
+		if err != nil {
+			if err == io.EOF || errors.Is(err, os.ErrClosed) {
+				log.Infof("Stopped reading LED state from %s", path)
+				return nil
+			}
+			log.Errorf("Error reading LED state from %s: %s", path, err.Error())
+			return err
+		}
+		state := report[:n]
+		if out.ReportId != 0 {
+			// Composite gadget output reports start with the report ID
+			if n < 2 || state[0] != out.ReportId {
+				continue
+			}
+			state = state[1:]
+		}
+		if len(state) == 0 {
+			continue
+		}
+		log.Debugf("Received LED state from host: 0x%02x", state[0])
+		leds.Set(state[0])
+	}
+}
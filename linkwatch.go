@@ -0,0 +1,91 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// StaleLinks are the devices, by evdev path, that stopped sending events
+// with keys or buttons held
+type StaleLinks struct {
+	mu    sync.Mutex
+	stale map[string]bool
+}
+
+var Stale = &StaleLinks{stale: make(map[string]bool, 0)}
+
+func (s *StaleLinks) Set(path string, stale bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stale {
+		s.stale[path] = true
+	} else {
+		delete(s.stale, path)
+	}
+}
+
+func (s *StaleLinks) Get(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stale[path]
+}
+
+// LinkWatchdog notices a device going silent while keys or buttons are
+// held, eg. a Bluetooth keyboard carried out of range before BlueZ notices
+// the link is gone. Autorepeat events generated by the kernel for the held
+// keys don't count as the device being alive.
+type LinkWatchdog struct {
+	// Disabled if zero
+	Timeout time.Duration
+	Device  evdev.InputDevice
+
+	lastEvent time.Time
+	stale     bool
+}
+
+func NewLinkWatchdog(timeout time.Duration, dev evdev.InputDevice) *LinkWatchdog {
+	return &LinkWatchdog{Timeout: timeout, Device: dev, lastEvent: time.Now()}
+}
+
+// Records an event read from the device
+func (w *LinkWatchdog) Event(event *evdev.InputEvent, now time.Time) {
+	if event.Type == evdev.EV_SYN || (event.Type == evdev.EV_KEY && event.Value == 2) {
+		return
+	}
+	w.lastEvent = now
+	if w.stale {
+		log.Infof("Events from %s (%s) resumed, treating it as reconnected", w.Device.Name, w.Device.Fn)
+		w.stale = false
+		Stale.Set(w.Device.Fn, false)
+	}
+}
+
+// Returns how long until the device is considered stale, and false if the
+// watchdog is disabled or already expired
+func (w *LinkWatchdog) Due(now time.Time) (time.Duration, bool) {
+	if w.Timeout <= 0 || w.stale {
+		return 0, false
+	}
+	return w.Timeout - now.Sub(w.lastEvent), true
+}
+
+// Returns true once the device has been silent for the timeout with keys
+// or buttons held, marking it stale. The caller releases what is held.
+func (w *LinkWatchdog) Expired(held bool, now time.Time) bool {
+	if !held {
+		return false
+	}
+	if due, ok := w.Due(now); !ok || due > 0 {
+		return false
+	}
+	log.Warnf("No events from %s (%s) for %s with keys or buttons held, releasing them", w.Device.Name, w.Device.Fn, w.Timeout)
+	w.stale = true
+	Stale.Set(w.Device.Fn, true)
+	return true
+}
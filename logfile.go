@@ -0,0 +1,88 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"sync"
+)
+
+// Number of rotated log files kept, as <file>.1 (newest) to <file>.N
+const LOG_BACKUPS = 2
+
+// Appends to a log file, rotating it once it grows past the maximum size
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	size    int64
+	file    *os.File
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	for i := LOG_BACKUPS; i > 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i-1), fmt.Sprintf("%s.%d", f.path, i))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	if f.file == nil {
+		err = f.open()
+	} else if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err = f.rotate()
+	}
+	if f.file == nil {
+		// Keep logging to stderr rather than losing the messages
+		fmt.Fprintf(os.Stderr, "Failed to open log file %s: %s\n", f.path, err.Error())
+		return os.Stderr.Write(p)
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// SetupLogFile writes the log to a file instead of stderr, rotating it when
+// it grows past maxSizeMB megabytes (0 never rotates).
+func SetupLogFile(path string, maxSizeMB int) error {
+	file, err := openRotatingFile(path, int64(maxSizeMB)*1024*1024)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	log.SetOutput(file)
+	return nil
+}
@@ -0,0 +1,207 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Macros triggered while one is playing wait for it, up to this many
+const MACRO_QUEUE_SIZE = 8
+
+// A single step of a macro: a key press or release, or a pause
+type MacroStep struct {
+	Code  uint16
+	Down  bool
+	Delay time.Duration
+}
+
+// Macros played back when their trigger key is pressed, with Delay
+// between the steps
+type Macros struct {
+	Steps map[uint16][]MacroStep
+	Delay time.Duration
+}
+
+// ParseMacro parses the actions of a macro:
+//
+//	+KEY_NAME   press a key
+//	-KEY_NAME   release a key
+//	KEY_NAME    press and release a key
+//	text:hello  type a string (US keymap)
+//	delay:100   wait for 100 ms
+func ParseMacro(actions []string) ([]MacroStep, error) {
+	steps := make([]MacroStep, 0, len(actions))
+	key := func(name string) (uint16, error) {
+		code, ok := KeyCode(name)
+		if !ok {
+			return 0, fmt.Errorf("unknown key: %s", name)
+		}
+		if _, ok := HidUsage(code, true); !ok {
+			return 0, fmt.Errorf("key can't be sent to the host: %s", name)
+		}
+		return code, nil
+	}
+	for _, action := range actions {
+		switch {
+		case strings.HasPrefix(action, "text:"):
+			strokes, err := KeyStrokes(USKeymap, strings.TrimPrefix(action, "text:"))
+			if err != nil {
+				return nil, err
+			}
+			for _, stroke := range strokes {
+				if stroke.Shift {
+					steps = append(steps, MacroStep{Code: evdev.KEY_LEFTSHIFT, Down: true})
+				}
+				steps = append(steps, MacroStep{Code: stroke.Code, Down: true}, MacroStep{Code: stroke.Code})
+				if stroke.Shift {
+					steps = append(steps, MacroStep{Code: evdev.KEY_LEFTSHIFT})
+				}
+			}
+		case strings.HasPrefix(action, "delay:"):
+			ms, err := strconv.Atoi(strings.TrimPrefix(action, "delay:"))
+			if err != nil || ms < 0 {
+				return nil, fmt.Errorf("invalid delay: %s", action)
+			}
+			steps = append(steps, MacroStep{Delay: time.Duration(ms) * time.Millisecond})
+		case strings.HasPrefix(action, "+"), strings.HasPrefix(action, "-"):
+			code, err := key(action[1:])
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, MacroStep{Code: code, Down: action[0] == '+'})
+		default:
+			code, err := key(action)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, MacroStep{Code: code, Down: true}, MacroStep{Code: code})
+		}
+	}
+	return steps, nil
+}
+
+// ParseMacros validates the macros of the configuration, keyed by the
+// evdev name of their trigger key. Keys without a name in the evdev
+// bindings (eg. KEY_MACRO1) can be given as a number.
+func ParseMacros(macros map[string][]string, delayMs int) (*Macros, error) {
+	m := &Macros{
+		Steps: make(map[uint16][]MacroStep, len(macros)),
+		Delay: time.Duration(delayMs) * time.Millisecond,
+	}
+	for trigger, actions := range macros {
+		code, ok := KeyCode(trigger)
+		if !ok {
+			number, err := strconv.ParseUint(trigger, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("unknown macro trigger key: %s", trigger)
+			}
+			code = uint16(number)
+		}
+		steps, err := ParseMacro(actions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid macro for %s: %w", trigger, err)
+		}
+		m.Steps[code] = steps
+	}
+	return m, nil
+}
+
+// A macro triggered on a keyboard, waiting to be played back
+type macroRun struct {
+	trigger uint16
+	steps   []MacroStep
+}
+
+// Plays back the macros triggered on the keyboard one after another until
+// the context is done, so the device is still read while a macro waits
+// between its steps. Returns a channel closed once stopped. Without it
+// macros are played back right away.
+func (t *KeyboardTranslator) PlayMacros(ctx context.Context) <-chan struct{} {
+	t.macroQueue = make(chan macroRun, MACRO_QUEUE_SIZE)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case run := <-t.macroQueue:
+				t.playMacro(ctx, run.trigger, run.steps)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return done
+}
+
+// Plays back a macro through the merged keyboard. Keys the macro leaves
+// pressed are released at the end, or when the context is done.
+func (t *KeyboardTranslator) playMacro(ctx context.Context, trigger uint16, steps []MacroStep) {
+	log.Debugf("Playing macro of key %d on %s (%s)", trigger, t.Device.Name, t.Device.Fn)
+	wait := func(d time.Duration) bool {
+		select {
+		case <-time.After(d):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for i, step := range steps {
+		if i > 0 && t.Macros.Delay > 0 && !wait(t.Macros.Delay) {
+			break
+		}
+		if step.Delay > 0 {
+			if !wait(step.Delay) {
+				break
+			}
+			continue
+		}
+		keyCode, ok := HidUsage(step.Code, t.Keyboard.NKRO())
+		if !ok {
+			continue
+		}
+		t.Keyboard.Update(&t.macroKeys, func() {
+			if step.Down {
+				t.macroKeys.Press(keyCode)
+			} else {
+				t.macroKeys.Release(keyCode)
+			}
+		})
+	}
+	if t.macroKeys.Pressed() {
+		t.Keyboard.Update(&t.macroKeys, t.macroKeys.ReleaseAll)
+	}
+}
+
+// Plays back the macro of a trigger key, returns true if the event is
+// part of a macro trigger and shouldn't be forwarded
+func (t *KeyboardTranslator) macro(code uint16, value int32) bool {
+	if t.Macros == nil {
+		return false
+	}
+	steps, ok := t.Macros.Steps[code]
+	if !ok {
+		return false
+	}
+	if value != 1 { // Key down
+		return true
+	}
+	if t.macroQueue == nil {
+		t.playMacro(context.Background(), code, steps)
+		return true
+	}
+	select {
+	case t.macroQueue <- macroRun{trigger: code, steps: steps}:
+	default:
+		log.Warnf("Too many macros queued on %s (%s), dropping the macro of key %d", t.Device.Name, t.Device.Fn, code)
+	}
+	return true
+}
@@ -0,0 +1,55 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bytes"
+	"context"
+	evdev "github.com/gvalkov/golang-evdev"
+	"testing"
+	"time"
+)
+
+func TestMacroDoesNotBlockInput(t *testing.T) {
+	macros, err := ParseMacros(map[string][]string{"KEY_F1": {"+KEY_LEFTCTRL", "delay:60000", "KEY_X"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan InputMessage, 10)
+	translator := NewKeyboardTranslator(NewMergedKeyboard(output, false), nil, nil, 0, evdev.InputDevice{})
+	translator.Macros = macros
+	ctx, cancel := context.WithCancel(context.Background())
+	done := translator.PlayMacros(ctx)
+
+	translator.Event(keyEvent(evdev.KEY_F1, 1))
+	// The macro presses its first key and waits
+	report := <-output
+	if !bytes.Equal(report.Message, []byte{LEFT_CONTROL, 0, 0, 0, 0, 0, 0, 0}) {
+		t.Fatalf("unexpected report from the macro: %v", report.Message)
+	}
+	// Input of the device is still handled in the meantime
+	translator.Event(keyEvent(evdev.KEY_F1, 0))
+	translator.Event(keyEvent(evdev.KEY_A, 1))
+	select {
+	case report = <-output:
+		if !bytes.Equal(report.Message, []byte{LEFT_CONTROL, 0, 4, 0, 0, 0, 0, 0}) {
+			t.Fatalf("unexpected report for a key pressed during the macro: %v", report.Message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("key pressed during the macro was not handled")
+	}
+
+	// Stopping releases the keys held by the macro
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("macro playback didn't stop")
+	}
+	reports := drain(output)
+	if len(reports) != 1 || !bytes.Equal(reports[0], []byte{0, 0, 4, 0, 0, 0, 0, 0}) {
+		t.Fatalf("expected the macro keys to be released, got %v", reports)
+	}
+}
@@ -0,0 +1,92 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"github.com/loov/hrtime"
+	"sync"
+)
+
+// MergedKeyboard is the single keyboard the host sees. It holds the union
+// of the keys pressed on every keyboard, so modifiers held on one keyboard
+// apply to keys pressed on another.
+type MergedKeyboard struct {
+	Output chan<- InputMessage
+
+	mu    sync.Mutex
+	state KeyboardState
+	held  map[uint16]int
+}
+
+func NewMergedKeyboard(output chan<- InputMessage, nkro bool) *MergedKeyboard {
+	return &MergedKeyboard{
+		Output: output,
+		state:  KeyboardState{NKRO: nkro},
+		held:   make(map[uint16]int, 0),
+	}
+}
+
+// Returns true if the merged reports are N-key rollover reports
+func (m *MergedKeyboard) NKRO() bool {
+	return m.state.NKRO
+}
+
+func containsKey(keys []uint16, key uint16) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Update applies a change to the state of one keyboard and sends the
+// merged report, which is also returned. A key stays pressed until it is
+// released on every keyboard holding it. Reports are sent in the order the
+// updates are made.
+func (m *MergedKeyboard) Update(k *KeyboardState, update func()) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	before := append([]uint16{}, k.keysDown...)
+	update()
+	for _, key := range k.keysDown {
+		if !containsKey(before, key) {
+			m.held[key]++
+			if m.held[key] == 1 {
+				m.state.Press(key)
+			}
+		}
+	}
+	for _, key := range before {
+		if !containsKey(k.keysDown, key) {
+			m.held[key]--
+			if m.held[key] <= 0 {
+				delete(m.held, key)
+				m.state.Release(key)
+			}
+		}
+	}
+
+	report := m.state.Report()
+	m.Output <- InputMessage{Timestamp: hrtime.Now(), Message: report}
+	return report
+}
+
+// Repeat sends a release and a press of a key held down, without changing
+// the merged state, so the key repeats on the host even while another
+// keyboard holds it too
+func (m *MergedKeyboard) Repeat(key uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held[key] == 0 {
+		return
+	}
+	keysDown := m.state.keysDown
+	m.state.Release(key)
+	m.Output <- InputMessage{Timestamp: hrtime.Now(), Message: m.state.Report()}
+	m.state.keysDown = keysDown
+	m.Output <- InputMessage{Timestamp: hrtime.Now(), Message: m.state.Report()}
+}
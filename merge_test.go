@@ -0,0 +1,50 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bytes"
+	evdev "github.com/gvalkov/golang-evdev"
+	"testing"
+)
+
+func TestMergedKeyboardTwoKeyboards(t *testing.T) {
+	output := make(chan InputMessage, 10)
+	merged := NewMergedKeyboard(output, false)
+	first := NewKeyboardTranslator(merged, nil, nil, 0, evdev.InputDevice{Fn: "/dev/input/event0"})
+	second := NewKeyboardTranslator(merged, nil, nil, 0, evdev.InputDevice{Fn: "/dev/input/event1"})
+
+	steps := []struct {
+		translator *KeyboardTranslator
+		event      *evdev.InputEvent
+		expected   []byte
+	}{
+		// A modifier held on one keyboard applies to keys on the other
+		{first, keyEvent(evdev.KEY_LEFTSHIFT, 1), []byte{LEFT_SHIFT, 0, 0, 0, 0, 0, 0, 0}},
+		{second, keyEvent(evdev.KEY_A, 1), []byte{LEFT_SHIFT, 0, 4, 0, 0, 0, 0, 0}},
+		{first, keyEvent(evdev.KEY_B, 1), []byte{LEFT_SHIFT, 0, 4, 5, 0, 0, 0, 0}},
+		// The same key held on both stays pressed until released on both
+		{first, keyEvent(evdev.KEY_A, 1), []byte{LEFT_SHIFT, 0, 4, 5, 0, 0, 0, 0}},
+		{second, keyEvent(evdev.KEY_A, 0), []byte{LEFT_SHIFT, 0, 4, 5, 0, 0, 0, 0}},
+		{first, keyEvent(evdev.KEY_A, 0), []byte{LEFT_SHIFT, 0, 5, 0, 0, 0, 0, 0}},
+		{first, keyEvent(evdev.KEY_LEFTSHIFT, 0), []byte{0, 0, 5, 0, 0, 0, 0, 0}},
+	}
+	for i, step := range steps {
+		step.translator.Event(step.event)
+		reports := drain(output)
+		if len(reports) != 1 || !bytes.Equal(reports[0], step.expected) {
+			t.Fatalf("step %d: expected %v, got %v", i, step.expected, reports)
+		}
+	}
+
+	// A keyboard going away only releases its own keys
+	second.Event(keyEvent(evdev.KEY_C, 1))
+	drain(output)
+	first.ReleaseAll()
+	reports := drain(output)
+	if len(reports) != 1 || !bytes.Equal(reports[0], []byte{0, 0, 6, 0, 0, 0, 0, 0}) {
+		t.Fatalf("expected only the key of the other keyboard, got %v", reports)
+	}
+}
@@ -0,0 +1,119 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+type Counter struct {
+	Name   string
+	Help   string
+	Labels string
+	value  uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+var metricsMutex sync.Mutex
+var registeredCounters = make([]*Counter, 0)
+
+// Creates and registers a counter. Counters sharing a name should be
+// registered next to each other, differing only by labels.
+func NewCounter(name string, help string, labels string) *Counter {
+	c := &Counter{Name: name, Help: help, Labels: labels}
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	registeredCounters = append(registeredCounters, c)
+	return c
+}
+
+var (
+	KeyboardReportsCounter   = NewCounter("hidproxy_keyboard_reports_total", "Keyboard reports forwarded to the host.", "")
+	MouseReportsCounter      = NewCounter("hidproxy_mouse_reports_total", "Mouse reports forwarded to the host.", "")
+	ConsumerReportsCounter   = NewCounter("hidproxy_consumer_reports_total", "Consumer control reports forwarded to the host.", "")
+	TabletReportsCounter     = NewCounter("hidproxy_tablet_reports_total", "Absolute pointer reports forwarded to the host.", "")
+	GamepadReportsCounter    = NewCounter("hidproxy_gamepad_reports_total", "Gamepad reports forwarded to the host.", "")
+	DigitizerReportsCounter  = NewCounter("hidproxy_digitizer_reports_total", "Multitouch digitizer reports forwarded to the host.", "")
+	DroppedReportsCounter    = NewCounter("hidproxy_dropped_motion_reports_total", "Mouse motion reports dropped because a writer fell behind.", "")
+	UnknownKeysCounter       = NewCounter("hidproxy_unknown_keys_dropped_total", "Key events dropped because the key has no HID usage.", "")
+	DeviceConnectsCounter    = NewCounter("hidproxy_device_connects_total", "Input devices attached.", "")
+	DeviceReconnectsCounter  = NewCounter("hidproxy_device_reconnects_total", "Input devices attached again after a disconnect.", "")
+	DeviceDisconnectsCounter = NewCounter("hidproxy_device_disconnects_total", "Input devices detached.", "")
+	KeyboardWriteErrors      = NewCounter("hidproxy_hid_write_errors_total", "Failed writes to HID gadget files.", `report="keyboard"`)
+	MouseWriteErrors         = NewCounter("hidproxy_hid_write_errors_total", "Failed writes to HID gadget files.", `report="mouse"`)
+	ConsumerWriteErrors      = NewCounter("hidproxy_hid_write_errors_total", "Failed writes to HID gadget files.", `report="consumer"`)
+	TabletWriteErrors        = NewCounter("hidproxy_hid_write_errors_total", "Failed writes to HID gadget files.", `report="tablet"`)
+	GamepadWriteErrors       = NewCounter("hidproxy_hid_write_errors_total", "Failed writes to HID gadget files.", `report="gamepad"`)
+	DigitizerWriteErrors     = NewCounter("hidproxy_hid_write_errors_total", "Failed writes to HID gadget files.", `report="digitizer"`)
+)
+
+// Writes all counters in the Prometheus text exposition format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	previous := ""
+	for _, c := range registeredCounters {
+		if c.Name != previous {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name)
+			previous = c.Name
+		}
+		if c.Labels != "" {
+			fmt.Fprintf(w, "%s{%s} %d\n", c.Name, c.Labels, c.Value())
+		} else {
+			fmt.Fprintf(w, "%s %d\n", c.Name, c.Value())
+		}
+	}
+
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	written := false
+	for _, l := range registeredLatencies {
+		s := l.Summary()
+		if s.Count == 0 {
+			continue
+		}
+		if !written {
+			fmt.Fprintf(w, "# HELP hidproxy_report_latency_seconds Time from reading an input event to writing the HID report.\n# TYPE hidproxy_report_latency_seconds summary\n")
+			written = true
+		}
+		fmt.Fprintf(w, "hidproxy_report_latency_seconds{report=%q,quantile=\"0\"} %g\n", l.Report, s.Min.Seconds())
+		fmt.Fprintf(w, "hidproxy_report_latency_seconds{report=%q,quantile=\"0.99\"} %g\n", l.Report, s.P99.Seconds())
+		fmt.Fprintf(w, "hidproxy_report_latency_seconds{report=%q,quantile=\"1\"} %g\n", l.Report, s.Max.Seconds())
+		fmt.Fprintf(w, "hidproxy_report_latency_seconds_sum{report=%q} %g\n", l.Report, s.Sum.Seconds())
+		fmt.Fprintf(w, "hidproxy_report_latency_seconds_count{report=%q} %d\n", l.Report, s.Count)
+	}
+
+	levels := Batteries.All()
+	if len(levels) > 0 {
+		fmt.Fprintf(w, "# HELP hidproxy_battery_percent Battery level of connected devices.\n# TYPE hidproxy_battery_percent gauge\n")
+		for _, level := range levels {
+			fmt.Fprintf(w, "hidproxy_battery_percent{address=%q,name=%q} %d\n", level.Address, level.Name, level.Percentage)
+		}
+	}
+}
+
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", MetricsHandler)
+	log.Infof("Serving metrics on http://%s/metrics", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Errorf("Metrics server failed: %s", err.Error())
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Scales relative X/Y movement, carrying the fractional remainder over to
+// the next event so slow movements are not lost to rounding. Scrolling can
+// be inverted for "natural" scrolling.
+type MouseMotion struct {
+	Scale          float64
+	AccelThreshold int32
+	AccelFactor    float64
+	InvertScroll   bool
+	InvertHScroll  bool
+	remainderX     float64
+	remainderY     float64
+}
+
+func NewMouseMotion(config Config) *MouseMotion {
+	scale := config.MouseScale
+	if scale == 0 {
+		scale = 1.0
+	}
+	return &MouseMotion{
+		Scale:          scale,
+		AccelThreshold: int32(config.MouseAccelThreshold),
+		AccelFactor:    config.MouseAccelFactor,
+		InvertScroll:   config.InvertScroll,
+		InvertHScroll:  config.InvertHScroll,
+	}
+}
+
+// Returns the vertical and horizontal scroll amounts of a report
+func (m *MouseMotion) Scroll(wheel int32, pan int32) (int32, int32) {
+	if m.InvertScroll {
+		wheel = -wheel
+	}
+	if m.InvertHScroll {
+		pan = -pan
+	}
+	return wheel, pan
+}
+
+func (m *MouseMotion) X(value int32) int32 {
+	return m.apply(value, &m.remainderX)
+}
+
+func (m *MouseMotion) Y(value int32) int32 {
+	return m.apply(value, &m.remainderY)
+}
+
+func (m *MouseMotion) apply(value int32, remainder *float64) int32 {
+	scaled := float64(value) * m.Scale
+	if m.AccelFactor > 0 && (value > m.AccelThreshold || value < -m.AccelThreshold) {
+		scaled *= m.AccelFactor
+	}
+	scaled += *remainder
+	delta := math.Round(scaled)
+	*remainder = scaled - delta
+	return ClampInt8(int32(delta))
+}
+
+// Clamps a relative value to the signed byte range of the report fields
+func ClampInt8(value int32) int32 {
+	if value > 127 {
+		return 127
+	}
+	if value < -127 {
+		return -127
+	}
+	return value
+}
+
+type MouseButton struct {
+	Code uint16
+	Bit  uint8
+}
+
+// Mouse buttons that can be remapped, with their default report button bits
+var MouseButtonNames = map[string]MouseButton{
+	"BTN_LEFT":    {evdev.BTN_LEFT, BUTTON_LEFT},
+	"BTN_RIGHT":   {evdev.BTN_RIGHT, BUTTON_RIGHT},
+	"BTN_MIDDLE":  {evdev.BTN_MIDDLE, BUTTON_MIDDLE},
+	"BTN_SIDE":    {evdev.BTN_SIDE, BUTTON_SIDE},
+	"BTN_EXTRA":   {evdev.BTN_EXTRA, BUTTON_EXTRA},
+	"BTN_BACK":    {evdev.BTN_BACK, BUTTON_SIDE},
+	"BTN_FORWARD": {evdev.BTN_FORWARD, BUTTON_EXTRA},
+}
+
+// ParseMouseButtonMap returns the button table used by the mouse handler:
+// MouseButtons (and MouseExtraButtons if extra is set) with the remapped
+// buttons replaced. Targets are button names or report button numbers
+// (1-5), and an empty target drops the button.
+func ParseMouseButtonMap(buttonMap map[string]string, extra bool) (map[uint16]uint8, error) {
+	buttons := make(map[uint16]uint8, len(MouseButtons)+len(MouseExtraButtons)+len(buttonMap))
+	for code, bit := range MouseButtons {
+		buttons[code] = bit
+	}
+	if extra {
+		for code, bit := range MouseExtraButtons {
+			buttons[code] = bit
+		}
+	}
+	for from, to := range buttonMap {
+		from = strings.ToUpper(strings.TrimSpace(from))
+		button, ok := MouseButtonNames[from]
+		if !ok {
+			return nil, fmt.Errorf("unknown mouse button in mouse button map: %s", from)
+		}
+		code := button.Code
+		to = strings.ToUpper(strings.TrimSpace(to))
+		if to == "" {
+			delete(buttons, code)
+			continue
+		}
+		bit, err := parseMouseButtonTarget(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target for %s in mouse button map: %s", from, to)
+		}
+		buttons[code] = bit
+	}
+	return buttons, nil
+}
+
+// Returns the report button bit of a button name or number (1-5)
+func parseMouseButtonTarget(to string) (uint8, error) {
+	if target, ok := MouseButtonNames[to]; ok {
+		return target.Bit, nil
+	}
+	number, err := strconv.Atoi(to)
+	if err != nil || number < 1 || number > MOUSE_BUTTON_COUNT {
+		return 0, fmt.Errorf("unknown mouse button: %s", to)
+	}
+	return 1 << (number - 1), nil
+}
+
+// MouseChord is a set of buttons that send another button when they are
+// pressed together, eg. left and right for a middle button
+type MouseChord struct {
+	Buttons []uint16
+	Bit     uint8
+}
+
+func (c MouseChord) has(code uint16) bool {
+	for _, button := range c.Buttons {
+		if button == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMouseChords parses chords like BTN_LEFT+BTN_RIGHT: BTN_MIDDLE. The
+// targets are button names or report button numbers (1-5).
+func ParseMouseChords(chords map[string]string) ([]MouseChord, error) {
+	parsed := make([]MouseChord, 0, len(chords))
+	for from, to := range chords {
+		chord := MouseChord{}
+		for _, name := range strings.Split(from, "+") {
+			name = strings.ToUpper(strings.TrimSpace(name))
+			button, ok := MouseButtonNames[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown mouse button in chord %s: %s", from, name)
+			}
+			if !chord.has(button.Code) {
+				chord.Buttons = append(chord.Buttons, button.Code)
+			}
+		}
+		if len(chord.Buttons) < 2 {
+			return nil, fmt.Errorf("mouse chord %s needs at least two buttons", from)
+		}
+		bit, err := parseMouseButtonTarget(strings.ToUpper(strings.TrimSpace(to)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid target for mouse chord %s: %s", from, to)
+		}
+		chord.Bit = bit
+		parsed = append(parsed, chord)
+	}
+	return parsed, nil
+}
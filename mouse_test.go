@@ -0,0 +1,46 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bytes"
+	evdev "github.com/gvalkov/golang-evdev"
+	"testing"
+)
+
+func TestInvertScroll(t *testing.T) {
+	hiresDev := evdev.InputDevice{Capabilities: map[evdev.CapabilityType][]evdev.CapabilityCode{
+		{Type: evdev.EV_REL}: {{Code: REL_WHEEL_HI_RES}, {Code: REL_HWHEEL_HI_RES}},
+	}}
+	tests := []struct {
+		name                        string
+		hires                       bool
+		invertScroll, invertHScroll bool
+		event                       *evdev.InputEvent
+		expected                    []byte
+	}{
+		{"legacy wheel", false, false, false, relEvent(evdev.REL_WHEEL, 1), []byte{0, 0, 0, 1}},
+		{"legacy wheel inverted", false, true, false, relEvent(evdev.REL_WHEEL, 1), []byte{0, 0, 0, 0xff}},
+		{"legacy wheel hscroll inverted", false, false, true, relEvent(evdev.REL_WHEEL, 1), []byte{0, 0, 0, 1}},
+		{"hires wheel", true, false, false, relEvent(REL_WHEEL_HI_RES, 120), []byte{0, 0, 0, MOUSE_WHEEL_MULTIPLIER, 0}},
+		{"hires wheel inverted", true, true, false, relEvent(REL_WHEEL_HI_RES, 120), []byte{0, 0, 0, uint8(256 - MOUSE_WHEEL_MULTIPLIER), 0}},
+		{"hires pan", true, false, false, relEvent(REL_HWHEEL_HI_RES, 120), []byte{0, 0, 0, 0, MOUSE_WHEEL_MULTIPLIER}},
+		{"hires pan inverted", true, false, true, relEvent(REL_HWHEEL_HI_RES, 120), []byte{0, 0, 0, 0, uint8(256 - MOUSE_WHEEL_MULTIPLIER)}},
+		{"hires pan scroll inverted", true, true, false, relEvent(REL_HWHEEL_HI_RES, 120), []byte{0, 0, 0, 0, MOUSE_WHEEL_MULTIPLIER}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.InvertScroll, config.InvertHScroll = test.invertScroll, test.invertHScroll
+			output := make(chan InputMessage, 10)
+			translator := NewMouseTranslator(output, test.hires, NewMouseMotion(config), MouseButtons, 0, hiresDev)
+			translator.Event(test.event)
+			reports := drain(output)
+			if len(reports) != 1 || !bytes.Equal(reports[0], test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, reports)
+			}
+		})
+	}
+}
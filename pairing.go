@@ -0,0 +1,140 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	"fmt"
+	"github.com/muka/go-bluetooth/bluez"
+	"github.com/muka/go-bluetooth/bluez/profile/adapter"
+	"github.com/muka/go-bluetooth/bluez/profile/agent"
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+)
+
+var pairing int32 = 0
+
+// Trusts and connects the paired input devices of an adapter that aren't
+// trusted yet, and pairs discovered input devices. Pairing with a device
+// isn't retried if it fails.
+func acceptInputDevices(a *adapter.Adapter1, adapterId string, tried map[string]bool) {
+	devices, err := a.GetDevices()
+	if err != nil {
+		log.Warnf("Unable to list devices on %s: %s", adapterId, err.Error())
+		return
+	}
+	for _, dev := range devices {
+		uuids, _ := dev.GetUUIDs()
+		if !isInputProfile(uuids) {
+			continue
+		}
+		name, err := dev.GetName()
+		if err != nil {
+			name = "?"
+		}
+		address, _ := dev.GetAddress()
+		paired, _ := dev.GetPaired()
+		trusted, _ := dev.GetTrusted()
+		if paired && trusted {
+			continue
+		}
+		if !paired {
+			if tried[address] {
+				continue
+			}
+			tried[address] = true
+			log.Infof("Pairing with %s (%s) on %s...", name, address, adapterId)
+			if err := dev.Pair(); err != nil {
+				log.Warnf("Failed to pair with %s (%s): %s", name, address, err.Error())
+				continue
+			}
+		}
+		log.Infof("Trusting and connecting %s (%s)", name, address)
+		if err := dev.SetTrusted(true); err != nil {
+			log.Warnf("Failed to trust %s (%s): %s", name, address, err.Error())
+			continue
+		}
+		if err := dev.Connect(); err != nil {
+			log.Warnf("Failed to connect to %s (%s): %s", name, address, err.Error())
+		}
+	}
+}
+
+// PairDevices makes the adapters discoverable and pairable for the window,
+// accepting pairing requests without a PIN. Input devices that pair are
+// trusted and connected. The adapters are restored to their previous
+// settings afterwards. Only one pairing window can be open at a time.
+func PairDevices(ctx context.Context, adapters []string, window time.Duration) error {
+	if !atomic.CompareAndSwapInt32(&pairing, 0, 1) {
+		return fmt.Errorf("pairing is already in progress")
+	}
+	defer atomic.StoreInt32(&pairing, 0)
+
+	conn, err := bluez.GetConnection(bluez.SystemBus)
+	if err != nil {
+		return err
+	}
+	ag := agent.NewSimpleAgent()
+	if err := agent.ExposeAgent(conn, ag, agent.CapNoInputNoOutput, true); err != nil {
+		return fmt.Errorf("failed to register pairing agent: %w", err)
+	}
+	defer agent.RemoveAgent(ag)
+
+	opened := make(map[string]*adapter.Adapter1, 0)
+	for _, adapterId := range adapters {
+		a, err := adapter.GetAdapter(adapterId)
+		if err != nil {
+			log.Warnf("Unable to open adapter %s: %s", adapterId, err.Error())
+			continue
+		}
+		discoverable, _ := a.GetDiscoverable()
+		pairable, _ := a.GetPairable()
+		defer func(adapterId string) {
+			log.Infof("Closing pairing window on %s", adapterId)
+			a.StopDiscovery()
+			a.SetDiscoverable(discoverable)
+			a.SetPairable(pairable)
+		}(adapterId)
+
+		// BlueZ also reverts the settings by itself if we don't get to
+		timeout := uint32(window / time.Second)
+		a.SetDiscoverableTimeout(timeout)
+		a.SetPairableTimeout(timeout)
+		if err := a.SetPairable(true); err != nil {
+			log.Warnf("Unable to make %s pairable: %s", adapterId, err.Error())
+			continue
+		}
+		if err := a.SetDiscoverable(true); err != nil {
+			log.Warnf("Unable to make %s discoverable: %s", adapterId, err.Error())
+			continue
+		}
+		if err := a.StartDiscovery(); err != nil {
+			log.Warnf("Unable to start discovery on %s: %s", adapterId, err.Error())
+		}
+		log.Infof("Opened pairing window on %s for %s", adapterId, window)
+		opened[adapterId] = a
+	}
+	if len(opened) == 0 {
+		return fmt.Errorf("no adapters available for pairing")
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	deadline := time.After(window)
+	tried := make(map[string]bool, 0)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-deadline:
+			return nil
+		case <-ticker.C:
+			for adapterId, a := range opened {
+				acceptInputDevices(a, adapterId, tried)
+			}
+		}
+	}
+}
@@ -0,0 +1,741 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	"fmt"
+	evdev "github.com/gvalkov/golang-evdev"
+	udev "github.com/jochenvg/go-udev"
+	"github.com/loov/hrtime"
+	"github.com/muka/go-bluetooth/api"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Proxy forwards input from evdev devices, and input injected with the
+// Send* methods, to the USB HID gadget.
+type Proxy struct {
+	configMutex    sync.Mutex
+	config         Config
+	configLoader   func() (Config, error)
+	keyRemap       map[uint16]uint16
+	mouseButtons   map[uint16]uint8
+	mouseChords    []MouseChord
+	hotkey         []uint16
+	macros         *Macros
+	layers         Layers
+	keyboardInput  chan InputMessage
+	mouseInput     chan InputMessage
+	consumerInput  chan InputMessage
+	tabletInput    chan InputMessage
+	gamepadInput   chan InputMessage
+	digitizerInput chan InputMessage
+	udc            *UdcMonitor
+	pause          *PauseState
+	reload         chan struct{}
+	// Set by Run if the gadget sleeps when idle
+	idle *IdleMonitor
+
+	// Attached devices and their type, for the control socket
+	devicesMutex sync.Mutex
+	devices      map[InputDevice]string
+
+	// Keys held on all keyboards, including injected ones
+	merged *MergedKeyboard
+
+	// Injected input has its own key and button state, merged with the
+	// keys of real keyboards
+	injectMutex sync.Mutex
+	keyboard    KeyboardState
+	buttons     uint8
+}
+
+func New(config Config) (*Proxy, error) {
+	if config.OutputMode != "" && config.OutputMode != OUTPUT_LOCAL && config.OutputMode != OUTPUT_NET {
+		return nil, fmt.Errorf("unknown output mode: %s", config.OutputMode)
+	}
+	if config.OutputMode == OUTPUT_NET && config.RemoteAddr == "" {
+		return nil, fmt.Errorf("net output mode requires a remote address")
+	}
+	config, err := applyBootProtocol(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.SetupHid && config.OutputMode != OUTPUT_NET {
+		if err := config.CheckGadget(); err != nil {
+			return nil, err
+		}
+	} else if config.SetupDigitizer {
+		if err := CheckMaxContacts(config.MaxContacts); err != nil {
+			return nil, err
+		}
+	}
+	keyRemap, err := ConfigKeyRemap(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.CheckDeviceRoles(); err != nil {
+		return nil, err
+	}
+	if err := CheckDevicePatterns(config.MatchDevices); err != nil {
+		return nil, err
+	}
+	mouseButtons, err := ParseMouseButtonMap(config.MouseButtonMap, config.MouseExtraButtons)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mouse button map: %w", err)
+	}
+	mouseChords, err := ParseMouseChords(config.MouseChords)
+	if err != nil {
+		return nil, err
+	}
+	hotkey, err := ParseHotkey(config.ToggleHotkey)
+	if err != nil {
+		return nil, err
+	}
+	macros, err := ParseMacros(config.Macros, config.MacroDelayMs)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := ParseLayers(config.Layers)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		config:        config,
+		keyRemap:      keyRemap,
+		mouseButtons:  mouseButtons,
+		mouseChords:   mouseChords,
+		hotkey:        hotkey,
+		macros:        macros,
+		layers:        layers,
+		keyboardInput: make(chan InputMessage),
+		mouseInput:    make(chan InputMessage),
+		udc:           NewUdcMonitor(),
+		pause:         NewPauseState(),
+		reload:        make(chan struct{}, 1),
+		devices:       make(map[InputDevice]string, 0),
+	}
+	p.merged = NewMergedKeyboard(p.keyboardInput, config.KeyboardNKRO)
+	if config.SetupConsumer && config.SetupKeyboard {
+		p.consumerInput = make(chan InputMessage)
+	}
+	if config.SetupTablet {
+		p.tabletInput = make(chan InputMessage)
+	}
+	if config.SetupGamepad {
+		p.gamepadInput = make(chan InputMessage)
+	}
+	if config.SetupDigitizer {
+		p.digitizerInput = make(chan InputMessage)
+	}
+	return p, nil
+}
+
+// SendKey presses or releases a key, given as an evdev key code (eg.
+// evdev.KEY_A). Media keys go to the consumer control device if enabled.
+// Safe to call concurrently with real device input; injected keys are
+// merged with the keys held on real keyboards.
+func (p *Proxy) SendKey(code uint16, down bool) error {
+	p.injectMutex.Lock()
+	defer p.injectMutex.Unlock()
+
+	if usage, ok := ConsumerCodes[code]; ok && p.consumerInput != nil {
+		if !down {
+			usage = 0
+		}
+		p.consumerInput <- InputMessage{
+			Timestamp: hrtime.Now(),
+			Message:   ConsumerReport(usage),
+		}
+		return nil
+	}
+	keyCode, ok := HidUsage(code, p.merged.NKRO())
+	if !ok {
+		return fmt.Errorf("unsupported key code: %d", code)
+	}
+	p.merged.Update(&p.keyboard, func() {
+		if down {
+			p.keyboard.Press(keyCode)
+		} else {
+			p.keyboard.Release(keyCode)
+		}
+	})
+	return nil
+}
+
+// TypeString types a string as key presses using the US keymap, adding
+// shift where needed. Nothing is typed if any character can't be mapped.
+// Keystrokes are spaced by the keyboard repeat delay (KbdDelay) so the
+// host doesn't drop characters.
+func (p *Proxy) TypeString(s string) error {
+	strokes, err := KeyStrokes(USKeymap, s)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(p.Config().KbdDelay) * time.Millisecond
+	for i, stroke := range strokes {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		if stroke.Shift {
+			if err := p.SendKey(evdev.KEY_LEFTSHIFT, true); err != nil {
+				return err
+			}
+		}
+		if err := p.SendKey(stroke.Code, true); err != nil {
+			return err
+		}
+		if err := p.SendKey(stroke.Code, false); err != nil {
+			return err
+		}
+		if stroke.Shift {
+			if err := p.SendKey(evdev.KEY_LEFTSHIFT, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SendMouseMove moves the mouse pointer relatively. Large movements are
+// split into multiple reports. Safe to call concurrently with device input.
+func (p *Proxy) SendMouseMove(dx int, dy int) {
+	p.injectMutex.Lock()
+	defer p.injectMutex.Unlock()
+
+	for first := true; first || dx != 0 || dy != 0; first = false {
+		x, y := ClampInt8(int32(dx)), ClampInt8(int32(dy))
+		dx, dy = dx-int(x), dy-int(y)
+		p.mouseInput <- InputMessage{
+			Timestamp: hrtime.Now(),
+			Message:   MouseReport(p.buttons, x, y, 0, 0, p.Config().MouseHiRes),
+		}
+	}
+}
+
+// SendMouseButton presses or releases a mouse button, given as an evdev
+// button code (eg. evdev.BTN_LEFT). Safe to call concurrently with device input.
+func (p *Proxy) SendMouseButton(button int, down bool) error {
+	bit, ok := MouseButtons[uint16(button)]
+	if !ok && p.Config().MouseExtraButtons {
+		bit, ok = MouseExtraButtons[uint16(button)]
+	}
+	if !ok {
+		return fmt.Errorf("unsupported mouse button: %d", button)
+	}
+
+	p.injectMutex.Lock()
+	defer p.injectMutex.Unlock()
+	p.buttons = SetButton(p.buttons, bit, down)
+	p.mouseInput <- InputMessage{
+		Timestamp: hrtime.Now(),
+		Message:   MouseReport(p.buttons, 0, 0, 0, 0, p.Config().MouseHiRes),
+	}
+	return nil
+}
+
+func (p *Proxy) setDevice(devId InputDevice, kind string) {
+	p.devicesMutex.Lock()
+	defer p.devicesMutex.Unlock()
+	p.devices[devId] = kind
+	Forwarded.Reset(devId.Device)
+	Stale.Set(devId.Device, false)
+}
+
+// Devices returns the attached input devices
+func (p *Proxy) Devices() []DeviceInfo {
+	p.devicesMutex.Lock()
+	defer p.devicesMutex.Unlock()
+	devices := make([]DeviceInfo, 0, len(p.devices))
+	for devId, kind := range p.devices {
+		device := DeviceInfo{
+			Name:    devId.Name,
+			Device:  devId.Device,
+			Address: InputDeviceAddress(devId.Device),
+			Type:    kind,
+			Events:  Forwarded.Get(devId.Device),
+			Stale:   Stale.Get(devId.Device),
+		}
+		if level, ok := Batteries.Get(device.Address); ok {
+			device.Battery = &level.Percentage
+		}
+		devices = append(devices, device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Device < devices[j].Device })
+	return devices
+}
+
+// RunUntilSignal runs the proxy until SIGINT or SIGTERM is received and
+// reloads the configuration on SIGHUP.
+func (p *Proxy) RunUntilSignal() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Info("Received SIGHUP, reloading configuration")
+				p.Reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return p.Run(ctx)
+}
+
+// HostState returns the USB device controller state as polled from sysfs,
+// eg. "configured" when the host is up or "suspended" while it sleeps. It
+// is empty unless the proxy set up a local gadget.
+func (p *Proxy) HostState() string {
+	if config := p.Config(); !config.SetupHid || config.OutputMode == OUTPUT_NET {
+		return ""
+	}
+	return p.udc.State()
+}
+
+// Run proxies input until the context is cancelled, then releases the
+// devices and tears down the gadget it set up. An error is returned if a
+// HID gadget file or the receiver can't be opened.
+func (p *Proxy) Run(ctx context.Context) error {
+	var handlers, writers sync.WaitGroup
+	var runErr error
+	config := p.Config()
+
+	log.SetLevel(config.LogLevel)
+	if config.LogEvents {
+		EnableEventLog()
+	}
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	// In net output mode the gadget is set up by the receiver
+	localGadget := config.SetupHid && config.OutputMode != OUTPUT_NET
+	if localGadget {
+		log.Info("Setting up HID files...")
+		SetupUSBGadget(config)
+	}
+
+	keyboardInput, mouseInput, consumerInput := p.keyboardInput, p.mouseInput, p.consumerInput
+	output := make(map[InputDevice]chan error, 0)
+	cancels := make(map[InputDevice]context.CancelFunc, 0)
+	seen := make(map[string]bool, 0)
+	// Bluetooth adapter each device is connected through
+	adapters := make(map[InputDevice]string, 0)
+
+	// Started on boot and after every disconnect
+	reconnect := make(chan struct{}, 1)
+	triggerReconnect := func() {
+		select {
+		case reconnect <- struct{}{}:
+		default:
+		}
+	}
+	if config.ConnectKnown {
+		go ConnectKnown(ctx, config.Adapters(), time.Duration(config.ConnectRetryInterval)*time.Second, config.ConnectMaxAttempts, reconnect)
+	}
+
+	if config.BatteryInterval > 0 {
+		go PollBatteries(ctx, config.Adapters(), time.Duration(config.BatteryInterval)*time.Second)
+	}
+
+	if config.MetricsAddr != "" {
+		go ServeMetrics(config.MetricsAddr)
+	}
+
+	var udevCh <-chan *udev.Device
+
+	defer api.Exit()
+	u := udev.Udev{}
+	if config.MonitorUdev {
+		log.Info("Starting udev monitoring for Bluetooth and input devices")
+		m := u.NewMonitorFromNetlink("udev")
+		m.FilterAddMatchSubsystem("bluetooth")
+		m.FilterAddMatchSubsystem("input")
+
+		udevCh, _ = m.DeviceChan(ctx)
+	}
+
+	// Writers are stopped only after all the handlers feeding them have quit
+	writerCtx, stopWriters := context.WithCancel(context.Background())
+	defer stopWriters()
+
+	keyboardOutput, mouseOutput, consumerOutput := HidOutputs(config)
+	tabletOutput, gamepadOutput := TabletOutput(config), GamepadOutput(config)
+	digitizerOutput := DigitizerOutput(config)
+	// Reports are dropped while the host is suspended. Only the state of a
+	// local gadget is known, the receiver tracks its own in net mode.
+	if localGadget {
+		go p.udc.Run(writerCtx, 500*time.Millisecond)
+		keyboardOutput.Udc, mouseOutput.Udc, consumerOutput.Udc = p.udc, p.udc, p.udc
+		tabletOutput.Udc, gamepadOutput.Udc, digitizerOutput.Udc = p.udc, p.udc, p.udc
+	}
+	keyboardOutput.Pause, mouseOutput.Pause, consumerOutput.Pause = p.pause, p.pause, p.pause
+	tabletOutput.Pause, gamepadOutput.Pause, digitizerOutput.Pause = p.pause, p.pause, p.pause
+	if config.MeasureLatency {
+		keyboardOutput.Latency, mouseOutput.Latency, consumerOutput.Latency = KeyboardLatency, MouseLatency, ConsumerLatency
+		tabletOutput.Latency, gamepadOutput.Latency, digitizerOutput.Latency = TabletLatency, GamepadLatency, DigitizerLatency
+		// Otherwise the latency is in the metrics
+		if config.MetricsAddr == "" {
+			go LogLatency(writerCtx, time.Minute)
+		}
+	}
+	if config.Record != "" {
+		recorder, err := NewRecorder(config.Record)
+		if err != nil {
+			return fmt.Errorf("failed to open recording: %w", err)
+		}
+		defer recorder.Close()
+		log.Infof("Recording reports to %s", config.Record)
+		keyboardOutput.Recorder, mouseOutput.Recorder, consumerOutput.Recorder = recorder, recorder, recorder
+		tabletOutput.Recorder, gamepadOutput.Recorder, digitizerOutput.Recorder = recorder, recorder, recorder
+	}
+	var idle *IdleMonitor
+	if config.IdleTimeout > 0 {
+		unbind := config.IdleUnbind
+		if unbind && !localGadget {
+			log.Warn("Gadget can only be unbound when idle if set up locally, closing files instead")
+			unbind = false
+		}
+		idle = NewIdleMonitor(time.Duration(config.IdleTimeout)*time.Second, unbind, p.udc)
+		go idle.Run(writerCtx)
+		p.idle = idle
+		keyboardOutput.Power, mouseOutput.Power, consumerOutput.Power = idle, idle, idle
+		tabletOutput.Power, gamepadOutput.Power, digitizerOutput.Power = idle, idle, idle
+	}
+
+	var leds *LedSync
+	if config.SyncLeds && config.SetupKeyboard && config.OutputMode == OUTPUT_NET {
+		log.Info("Keyboard LEDs are not synced in net output mode")
+	} else if config.SyncLeds && config.SetupKeyboard {
+		leds = NewLedSync()
+		go func() {
+			// Unbinding the gadget stops the reader, restart it on wake up
+			for {
+				ReadKeyboardLeds(writerCtx, keyboardOutput, leds)
+				if idle == nil || !idle.Unbind {
+					return
+				}
+				select {
+				case <-idle.Woken():
+				case <-writerCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// A writer that fails stops the proxy, meanwhile its input is drained
+	// so the handlers feeding it don't block
+	failed := make(chan error, 1)
+	// Reports are buffered between the handlers and each writer
+	startWriter := func(out HidOutput, reports <-chan InputMessage) {
+		input := make(chan InputMessage)
+		go NewReportQueue(out.Name, config.EventQueueSize).Run(writerCtx, reports, input)
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			err := SendReports(writerCtx, out, input)
+			if err == nil {
+				return
+			}
+			select {
+			case failed <- err:
+			default:
+			}
+			for {
+				select {
+				case <-input:
+				case <-writerCtx.Done():
+					return
+				}
+			}
+		}()
+	}
+	startWriter(keyboardOutput, keyboardInput)
+	startWriter(mouseOutput, mouseInput)
+	if consumerInput != nil {
+		startWriter(consumerOutput, consumerInput)
+	}
+	if p.tabletInput != nil {
+		startWriter(tabletOutput, p.tabletInput)
+	}
+	if p.gamepadInput != nil {
+		startWriter(gamepadOutput, p.gamepadInput)
+	}
+	if p.digitizerInput != nil {
+		startWriter(digitizerOutput, p.digitizerInput)
+	}
+
+	attached := func(path string) bool {
+		for devId := range output {
+			if devId.Device == path {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Opens an evdev node and starts handling it, unless it's already handled.
+	// The HID gadget and report writers are shared by all devices, so
+	// reconnecting devices simply start feeding the existing ones.
+	// Skipped devices are only logged once, as they are polled every second
+	skipped := make(map[string]bool, 0)
+	skip := func(path string, name string, reason string) {
+		if !skipped[path] {
+			log.Infof("Skipping %s (%s): %s", name, path, reason)
+			skipped[path] = true
+		}
+	}
+
+	attach := func(path string) {
+		// Runtime settings may have been reloaded
+		config := p.Config()
+		if attached(path) || !DeviceAllowed(config, path) {
+			return
+		}
+		dev, err := evdev.Open(path)
+		if err != nil {
+			return
+		}
+		// Keyboards may have extra nodes for system control keys or motion
+		// sensors, which are skipped unless asked for
+		if isSensor(path) && !config.IncludeSensors {
+			skip(path, dev.Name, "motion sensor")
+			dev.File.Close()
+			return
+		}
+		isMouse := false
+		for k := range dev.Capabilities {
+			if k.Name == "EV_REL" {
+				isMouse = true
+			}
+		}
+		keys := inspectKeys(*dev, p.keyRemap, p.macros)
+		isKeyboard := keys.keys || (keys.consumer && consumerInput != nil) || (keys.system && config.IncludeSystemControl)
+		// Combo devices with the mouse role disabled are read as keyboards
+		mac := InputDeviceAddress(path)
+		allows := func(role string) bool {
+			return config.AllowsRole(dev.Name, mac, role)
+		}
+		isMouse = isMouse && allows("mouse")
+		isKeyboard = isKeyboard && allows("keyboard")
+		log.Debugf("Device %s (%s), capabilities: %v (mouse=%t, kbd=%t)", dev.Name, dev.Fn, dev.Capabilities, isMouse, isKeyboard)
+		log.Debugf("isKeyboard: %t, isMouse: %t, setupMouse: %t", !isKeyboard, isMouse, config.SetupMouse)
+		// Gamepads, tablets and touch devices also report buttons as EV_KEY
+		handleGamepad := !isMouse && isGamepad(*dev) && config.SetupGamepad && allows("gamepad")
+		handleDigitizer := !isMouse && !handleGamepad && isMultitouch(*dev) && config.SetupDigitizer && allows("digitizer")
+		handleTablet := !isMouse && !handleGamepad && !handleDigitizer && isTablet(*dev) && config.SetupTablet && allows("tablet")
+		handleKeyboard := isKeyboard && !isMouse && !handleTablet && !handleGamepad && !handleDigitizer && config.SetupKeyboard
+		handleMouse := isMouse && config.SetupMouse
+		if !handleKeyboard && !handleMouse && !handleTablet && !handleGamepad && !handleDigitizer {
+			if keys.system && !keys.keys && !keys.consumer {
+				skip(path, dev.Name, "only system control keys")
+			} else {
+				skip(path, dev.Name, "no input for the enabled devices")
+			}
+			dev.File.Close()
+			return
+		}
+		delete(skipped, path)
+
+		devId := InputDevice{
+			Device: dev.Fn,
+			Name:   dev.Name,
+		}
+		DeviceConnectsCounter.Inc()
+		if seen[devId.Name] {
+			DeviceReconnectsCounter.Inc()
+		}
+		seen[devId.Name] = true
+
+		devCtx, cancel := context.WithCancel(ctx)
+		adapters[devId] = InputDeviceAdapter(path)
+		output[devId] = make(chan error, 10)
+		cancels[devId] = cancel
+		options := DeviceOptions{
+			LinkTimeout: time.Duration(config.LinkTimeout) * time.Second,
+			Grab:        config.GrabDevices,
+			Pause:       p.pause,
+		}
+		handlers.Add(1)
+		if handleGamepad {
+			log.Infof("Attached gamepad: %s (%s)", dev.Name, dev.Fn)
+			p.setDevice(devId, "gamepad")
+			go func() {
+				defer handlers.Done()
+				HandleGamepad(devCtx, output[devId], p.gamepadInput, config.GrabDevices, *dev)
+			}()
+		} else if handleDigitizer {
+			log.Infof("Attached multitouch device: %s (%s)", dev.Name, dev.Fn)
+			p.setDevice(devId, "digitizer")
+			go func() {
+				defer handlers.Done()
+				HandleDigitizer(devCtx, output[devId], p.digitizerInput, config.MaxContacts, config.GrabDevices, *dev)
+			}()
+		} else if handleTablet {
+			log.Infof("Attached tablet: %s (%s)", dev.Name, dev.Fn)
+			p.setDevice(devId, "tablet")
+			go func() {
+				defer handlers.Done()
+				HandleTablet(devCtx, output[devId], p.tabletInput, config.GrabDevices, *dev)
+			}()
+		} else if handleKeyboard {
+			log.Infof("Attached keyboard: %s (%s)", dev.Name, dev.Fn)
+			p.setDevice(devId, "keyboard")
+			if leds != nil {
+				if err := leds.Add(devId); err != nil {
+					log.Warnf("Unable to sync LEDs to %s (%s): %s", devId.Name, devId.Device, err.Error())
+				}
+			}
+			options.Rate, options.Delay = config.Repeat(dev.Name, mac)
+			options.SoftwareRepeat = config.SoftwareRepeat
+			translator := NewKeyboardTranslator(p.merged, consumerInput, p.keyRemap, time.Duration(config.DebounceMs)*time.Millisecond, *dev)
+			translator.Hotkey, translator.Pause, translator.Macros, translator.Layers = p.hotkey, p.pause, p.macros, p.layers
+			go func() {
+				defer handlers.Done()
+				HandleKeyboard(devCtx, output[devId], translator, options)
+			}()
+		} else {
+			log.Infof("Attached mouse: %s (%s)", dev.Name, dev.Fn)
+			p.setDevice(devId, "mouse")
+			translator := NewMouseTranslator(mouseInput, config.MouseHiRes, NewMouseMotion(config), p.mouseButtons, time.Duration(config.MouseCoalesceMs)*time.Millisecond, *dev)
+			translator.Chords, translator.ChordWindow = p.mouseChords, time.Duration(config.MouseChordMs)*time.Millisecond
+			go func() {
+				defer handlers.Done()
+				HandleMouse(devCtx, output[devId], translator, options)
+			}()
+		}
+	}
+
+	if config.ControlSocket != "" {
+		go p.ServeControl(ctx, config.ControlSocket)
+	}
+
+	// The gadget is set up and the writers are running
+	if err := SdNotify("READY=1"); err != nil {
+		log.Warnf("Failed to notify systemd: %s", err.Error())
+	}
+	go RunWatchdog(ctx)
+
+	ticker := time.NewTicker(1000 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("Shutting down...")
+			SdNotify("STOPPING=1")
+			handlers.Wait()
+			stopWriters()
+			writers.Wait()
+			if leds != nil {
+				for devId := range output {
+					leds.Remove(devId)
+				}
+			}
+			if localGadget {
+				TeardownUSBGadget()
+			}
+			return runErr
+		case runErr = <-failed:
+			log.Errorf("Stopping after a writer failed: %s", runErr.Error())
+			stop()
+		case d := <-udevCh:
+			if d.Subsystem() == "input" {
+				if d.Action() == "add" && strings.HasPrefix(filepath.Base(d.Devnode()), "event") {
+					log.Infof("New input device: %s", d.Devnode())
+					attach(d.Devnode())
+				}
+				if d.Action() == "remove" {
+					delete(skipped, d.Devnode())
+					for devId, cancel := range cancels {
+						if devId.Device == d.Devnode() {
+							log.Infof("Removed input device, stopping listening to: %s (%s)", devId.Name, devId.Device)
+							cancel()
+						}
+					}
+				}
+				continue
+			}
+			if d.Action() == "add" || d.Action() == "remove" {
+				checkAdapters := config.Adapters()
+				if adapterId := adapterFromPath(d.Devpath()); adapterId != "" {
+					checkAdapters = []string{adapterId}
+				}
+				for _, adapterId := range checkAdapters {
+					disconnected, err := GetDisconnectedDevices(adapterId)
+					if err != nil {
+						log.Errorf("Error checking disconnected devices on %s: %s", adapterId, err.Error())
+						continue
+					}
+					for _, device := range disconnected {
+						for devId, _ := range output {
+							if adapters[devId] != "" && adapters[devId] != adapterId {
+								continue
+							}
+							if strings.HasPrefix(devId.Name, device) {
+								log.Infof("Disconnected device on %s, stopping listening to: %s (%s)", adapterId, devId.Name, devId.Device)
+								cancels[devId]()
+							}
+						}
+					}
+				}
+			}
+		case <-p.reload:
+			if err := p.reloadConfig(); err != nil {
+				log.Errorf("%s", err.Error())
+				continue
+			}
+			log.Info("Reopening all input devices")
+			for _, cancel := range cancels {
+				cancel()
+			}
+		case <-ticker.C:
+			log.Debug("Polling for new devices in /dev/input")
+			paths, _ := evdev.ListInputDevicePaths("/dev/input/event*")
+			for _, path := range paths {
+				attach(path)
+			}
+
+			for id, eventOutput := range output {
+				select {
+				case msg := <-eventOutput:
+					if msg == nil {
+						log.Warnf("Event handler quit: %s", id.Device)
+					} else {
+						log.Errorf("Received error from %s: %s", id.Device, msg.Error())
+					}
+					if leds != nil {
+						leds.Remove(id)
+					}
+					DeviceDisconnectsCounter.Inc()
+					triggerReconnect()
+					cancels[id]()
+					delete(cancels, id)
+					delete(adapters, id)
+					delete(output, id)
+					p.devicesMutex.Lock()
+					delete(p.devices, id)
+					p.devicesMutex.Unlock()
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// ReportQueue buffers reports between the input handlers and a writer that
+// falls behind. When it is full, the oldest motion report is dropped to
+// make room for the new one; other reports (buttons) wait for room, so no
+// transitions are lost and the order is kept.
+type ReportQueue struct {
+	Name string
+	Size int
+
+	mu      sync.Mutex
+	queue   []InputMessage
+	dropped int
+	logged  time.Time
+	// Signalled when a report is added or taken
+	added chan struct{}
+	taken chan struct{}
+}
+
+func NewReportQueue(name string, size int) *ReportQueue {
+	if size < 1 {
+		size = 1
+	}
+	return &ReportQueue{
+		Name:  name,
+		Size:  size,
+		queue: make([]InputMessage, 0, size),
+		added: make(chan struct{}, 1),
+		taken: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Adds a report, waiting for room if the queue is full of reports that
+// can't be dropped
+func (q *ReportQueue) Push(ctx context.Context, msg InputMessage) {
+	for {
+		q.mu.Lock()
+		if len(q.queue) < q.Size {
+			q.queue = append(q.queue, msg)
+			q.mu.Unlock()
+			notify(q.added)
+			return
+		}
+		for i, queued := range q.queue {
+			if queued.Motion {
+				q.queue = append(append(q.queue[:i], q.queue[i+1:]...), msg)
+				q.drop()
+				q.mu.Unlock()
+				notify(q.added)
+				return
+			}
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.taken:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Counts a dropped report, logging at most once a second
+func (q *ReportQueue) drop() {
+	DroppedReportsCounter.Inc()
+	q.dropped++
+	if time.Since(q.logged) >= time.Second {
+		log.Warnf("The %s queue is full, dropped %d motion reports", q.Name, q.dropped)
+		q.dropped, q.logged = 0, time.Now()
+	}
+}
+
+// Removes the oldest report, returning false if there is none
+func (q *ReportQueue) pop() (InputMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queue) == 0 {
+		return InputMessage{}, false
+	}
+	msg := q.queue[0]
+	q.queue = q.queue[1:]
+	return msg, true
+}
+
+// Moves reports from input to the queue and from the queue to output until
+// the context is done
+func (q *ReportQueue) Run(ctx context.Context, input <-chan InputMessage, output chan<- InputMessage) {
+	go func() {
+		for {
+			select {
+			case msg := <-input:
+				q.Push(ctx, msg)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for {
+		msg, ok := q.pop()
+		if !ok {
+			select {
+			case <-q.added:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		notify(q.taken)
+		select {
+		case output <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Recordings start with the magic and a version, followed by frames of
+// the time since the start of the recording in nanoseconds (64-bit big
+// endian), the gadget node, a 16-bit big endian length and the report.
+const (
+	RECORDING_MAGIC   = "HIDREC"
+	RECORDING_VERSION = 1
+)
+
+// RecordedReport is a report read from a recording
+type RecordedReport struct {
+	Offset time.Duration
+	Node   uint8
+	Report []byte
+}
+
+// Recorder writes the reports sent to the gadget to a recording. It is
+// shared by all the outputs.
+type Recorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	w     *bufio.Writer
+	start time.Time
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{file: file, w: bufio.NewWriter(file), start: time.Now()}
+	r.w.WriteString(RECORDING_MAGIC)
+	r.w.WriteByte(RECORDING_VERSION)
+	return r, nil
+}
+
+// Records a report written to a gadget node, eg. /dev/hidg0
+func (r *Recorder) Record(path string, report []byte) {
+	node, err := gadgetNode(path)
+	if err != nil {
+		log.Warnf("Not recording report: %s", err.Error())
+		return
+	}
+	frame := make([]byte, 11, 11+len(report))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	binary.BigEndian.PutUint64(frame, uint64(time.Since(r.start)))
+	frame[8] = node
+	binary.BigEndian.PutUint16(frame[9:], uint16(len(report)))
+	frame = append(frame, report...)
+	if _, err := r.w.Write(frame); err != nil {
+		log.Warnf("Error writing to recording %s: %s", r.file.Name(), err.Error())
+	}
+	// Flushed right away, so the recording is usable if the proxy crashes
+	r.w.Flush()
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.Flush()
+	return r.file.Close()
+}
+
+// RecordingReader reads the reports of a recording in order
+type RecordingReader struct {
+	r *bufio.Reader
+}
+
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, len(RECORDING_MAGIC)+1)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(RECORDING_MAGIC)]) != RECORDING_MAGIC {
+		return nil, fmt.Errorf("not a HID report recording")
+	}
+	if header[len(RECORDING_MAGIC)] != RECORDING_VERSION {
+		return nil, fmt.Errorf("unsupported recording version %d", header[len(RECORDING_MAGIC)])
+	}
+	return &RecordingReader{r: reader}, nil
+}
+
+// Returns the next report, or io.EOF at the end of the recording
+func (r *RecordingReader) Next() (RecordedReport, error) {
+	header := make([]byte, 11)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return RecordedReport{}, fmt.Errorf("truncated recording")
+		}
+		return RecordedReport{}, err
+	}
+	report := make([]byte, binary.BigEndian.Uint16(header[9:]))
+	if _, err := io.ReadFull(r.r, report); err != nil {
+		return RecordedReport{}, fmt.Errorf("truncated recording")
+	}
+	return RecordedReport{
+		Offset: time.Duration(binary.BigEndian.Uint64(header)),
+		Node:   header[8],
+		Report: report,
+	}, nil
+}
+
+// Plays the reports back with their original timing, opening the writer for
+// each gadget node with open. Reports that are late are written right away.
+func PlayRecording(ctx context.Context, r *RecordingReader, open func(node uint8) (HidWriter, error)) error {
+	writers := make(map[uint8]HidWriter, 0)
+	start := time.Now()
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		w, ok := writers[rec.Node]
+		if !ok {
+			w, err = open(rec.Node)
+			if err != nil {
+				return err
+			}
+			writers[rec.Node] = w
+		}
+		if wait := time.Until(start.Add(rec.Offset)); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if err := w.WriteReport(rec.Report); err != nil {
+			log.Warnf("Error writing to /dev/hidg%d: %s", rec.Node, err.Error())
+		}
+	}
+}
+
+// Replay sets up the USB gadget if configured and writes the reports of a
+// recording to the gadget (or to a receiver in net output mode). No input
+// devices are needed.
+func Replay(ctx context.Context, config Config, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := NewRecordingReader(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	config, err = applyBootProtocol(config)
+	if err != nil {
+		return err
+	}
+	if config.SetupHid && config.OutputMode != OUTPUT_NET {
+		if err := config.CheckGadget(); err != nil {
+			return err
+		}
+		log.Info("Setting up HID files...")
+		SetupUSBGadget(config)
+	}
+
+	sinks := make([]ReportSink, 0)
+	defer func() {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+	}()
+	open := func(node uint8) (HidWriter, error) {
+		out := HidOutput{Name: "replay", Path: "/dev/hidg" + strconv.Itoa(int(node))}
+		out.setOutputMode(config)
+		sink, err := out.OpenSink()
+		if err != nil {
+			return nil, fmt.Errorf("error opening %s: %w", out.Path, err)
+		}
+		sinks = append(sinks, sink)
+		return sink, nil
+	}
+	log.Infof("Replaying %s...", path)
+	if err := PlayRecording(ctx, r, open); err != nil {
+		return err
+	}
+	log.Infof("Finished replaying %s", path)
+	return nil
+}
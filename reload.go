@@ -0,0 +1,169 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"reflect"
+	"strings"
+)
+
+// Settings (by YAML name) that can be changed without restarting. They
+// take effect when the input devices are reopened after a reload.
+var RuntimeSettings = []string{
+	"loglevel",
+	"key-remap",
+	"layout",
+	"mouse-button-map",
+	"mouse-extra-buttons",
+	"mouse-chords",
+	"mouse-chord-ms",
+	"mouse-scale",
+	"mouse-accel-threshold",
+	"mouse-accel-factor",
+	"mouse-coalesce-ms",
+	"invert-scroll",
+	"invert-hscroll",
+	"allow-devices",
+	"deny-devices",
+	"match-devices",
+	"kbdrepeat",
+	"kbddelay",
+	"kbdrepeat-overrides",
+	"software-repeat",
+	"device-roles",
+	"debounce-ms",
+	"grab-devices",
+	"toggle-hotkey",
+	"macros",
+	"layers",
+	"macro-delay-ms",
+}
+
+func isRuntimeSetting(name string) bool {
+	for _, setting := range RuntimeSettings {
+		if setting == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeRuntimeConfig returns the current config with the runtime settings
+// of the new config applied, and the names of the settings that changed
+// but require a restart.
+func MergeRuntimeConfig(current Config, updated Config) (Config, []string) {
+	merged := current
+	restart := make([]string, 0)
+	mergedValue := reflect.ValueOf(&merged).Elem()
+	updatedValue := reflect.ValueOf(updated)
+	for i := 0; i < mergedValue.NumField(); i++ {
+		name := strings.Split(mergedValue.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if reflect.DeepEqual(mergedValue.Field(i).Interface(), updatedValue.Field(i).Interface()) {
+			continue
+		}
+		if isRuntimeSetting(name) {
+			mergedValue.Field(i).Set(updatedValue.Field(i))
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	return merged, restart
+}
+
+// SetConfigLoader sets the function used to reload the configuration on
+// SIGHUP or the reload control command.
+func (p *Proxy) SetConfigLoader(loader func() (Config, error)) {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	p.configLoader = loader
+}
+
+func (p *Proxy) Config() Config {
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	return p.config
+}
+
+// Reload makes Run reload the configuration and reopen the input devices
+func (p *Proxy) Reload() {
+	select {
+	case p.reload <- struct{}{}:
+	default:
+	}
+}
+
+// Reloads the configuration and applies the runtime settings. The caller
+// reopens the input devices for them to take effect.
+func (p *Proxy) reloadConfig() error {
+	p.configMutex.Lock()
+	loader := p.configLoader
+	p.configMutex.Unlock()
+	if loader == nil {
+		log.Info("No configuration to reload")
+		return nil
+	}
+
+	updated, err := loader()
+	if err != nil {
+		return fmt.Errorf("failed to reload configuration: %w", err)
+	}
+	// The same as at startup, so the forced settings don't look changed
+	updated, err = applyBootProtocol(updated)
+	if err != nil {
+		return err
+	}
+	keyRemap, err := ConfigKeyRemap(updated)
+	if err != nil {
+		return err
+	}
+	if err := updated.CheckDeviceRoles(); err != nil {
+		return err
+	}
+	if err := CheckDevicePatterns(updated.MatchDevices); err != nil {
+		return err
+	}
+	mouseButtons, err := ParseMouseButtonMap(updated.MouseButtonMap, updated.MouseExtraButtons)
+	if err != nil {
+		return fmt.Errorf("invalid mouse button map: %w", err)
+	}
+	mouseChords, err := ParseMouseChords(updated.MouseChords)
+	if err != nil {
+		return err
+	}
+	hotkey, err := ParseHotkey(updated.ToggleHotkey)
+	if err != nil {
+		return err
+	}
+	macros, err := ParseMacros(updated.Macros, updated.MacroDelayMs)
+	if err != nil {
+		return err
+	}
+	layers, err := ParseLayers(updated.Layers)
+	if err != nil {
+		return err
+	}
+
+	p.configMutex.Lock()
+	defer p.configMutex.Unlock()
+	merged, restart := MergeRuntimeConfig(p.config, updated)
+	for _, name := range restart {
+		log.Warnf("Changing %s requires restart, ignoring", name)
+	}
+	p.config = merged
+	p.keyRemap = keyRemap
+	p.mouseButtons = mouseButtons
+	p.mouseChords = mouseChords
+	p.hotkey = hotkey
+	p.macros = macros
+	p.layers = layers
+	log.SetLevel(merged.LogLevel)
+	log.Info("Configuration reloaded")
+	return nil
+}
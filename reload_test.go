@@ -0,0 +1,66 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"github.com/sirupsen/logrus/hooks/test"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReloadRejectsInvalidDevicePatterns(t *testing.T) {
+	config := DefaultConfig()
+	config.MatchDevices = []string{"usb-*-event-kbd"}
+	p := &Proxy{config: config}
+	p.SetConfigLoader(func() (Config, error) {
+		updated := config
+		updated.MatchDevices = []string{"re:^Logitech (K|MX"}
+		return updated, nil
+	})
+	if err := p.reloadConfig(); err == nil {
+		t.Fatal("expected the reload to be rejected")
+	}
+	if !reflect.DeepEqual(p.Config().MatchDevices, config.MatchDevices) {
+		t.Errorf("match patterns changed by a rejected reload: %v", p.Config().MatchDevices)
+	}
+}
+
+func TestReloadForcedBootProtocol(t *testing.T) {
+	loaded := DefaultConfig()
+	loaded.ForceBootProtocol = true
+	loaded.KeyboardNKRO = true
+	config, err := applyBootProtocol(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{config: config}
+	p.SetConfigLoader(func() (Config, error) {
+		return loaded, nil
+	})
+
+	hook := test.NewGlobal()
+	defer hook.Reset()
+	if err := p.reloadConfig(); err != nil {
+		t.Fatalf("reload: %s", err.Error())
+	}
+	for _, entry := range hook.AllEntries() {
+		if strings.Contains(entry.Message, "requires restart") {
+			t.Errorf("unexpected restart setting: %s", entry.Message)
+		}
+	}
+	if p.Config().KeyboardNKRO {
+		t.Errorf("expected NKRO to stay disabled")
+	}
+
+	p.SetConfigLoader(func() (Config, error) {
+		updated := loaded
+		updated.KeyboardDescriptor = "/etc/go-hidproxy/keyboard.bin"
+		return updated, nil
+	})
+	if err := p.reloadConfig(); err == nil {
+		t.Errorf("expected a reload with a keyboard descriptor override to be rejected")
+	}
+}
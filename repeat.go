@@ -0,0 +1,82 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"time"
+)
+
+// Clock returns the current time, so timing can be faked in tests
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// The clock used unless another one is given
+var SystemClock Clock = systemClock{}
+
+// KeyRepeater repeats keys in the proxy (SoftwareRepeat), for keyboards
+// that don't honor the repeat settings set with EVIOCSREP. The last key
+// pressed repeats after Delay and then every Period until any key event,
+// by releasing and pressing it again with the modifiers still held.
+// Modifiers themselves don't repeat.
+type KeyRepeater struct {
+	Delay  time.Duration
+	Period time.Duration
+	Clock  Clock
+
+	key  uint16
+	next time.Time
+}
+
+func NewKeyRepeater(delay time.Duration, period time.Duration, clock Clock) *KeyRepeater {
+	return &KeyRepeater{Delay: delay, Period: period, Clock: clock}
+}
+
+// Starts repeating a key (HID usage code) pressed now
+func (r *KeyRepeater) Press(key uint16) {
+	if r == nil || r.Period <= 0 {
+		return
+	}
+	if _, ok := ModifierBit(key); ok {
+		return
+	}
+	r.key, r.next = key, r.Clock.Now().Add(r.Delay)
+}
+
+// Stops repeating, on any key event
+func (r *KeyRepeater) Stop() {
+	if r == nil {
+		return
+	}
+	r.key = 0
+}
+
+// Returns how long until the next repeat, and false if nothing repeats
+func (r *KeyRepeater) Due() (time.Duration, bool) {
+	if r == nil || r.key == 0 {
+		return 0, false
+	}
+	return r.next.Sub(r.Clock.Now()), true
+}
+
+// Returns the key to repeat if a repeat is due, scheduling the next one.
+// Repeats missed (eg. while blocked on a slow host) are not caught up.
+func (r *KeyRepeater) Tick() (uint16, bool) {
+	if due, ok := r.Due(); !ok || due > 0 {
+		return 0, false
+	}
+	now := r.Clock.Now()
+	r.next = r.next.Add(r.Period)
+	if r.next.Before(now) {
+		r.next = now.Add(r.Period)
+	}
+	return r.key, true
+}
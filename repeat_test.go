@@ -0,0 +1,144 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bytes"
+	evdev "github.com/gvalkov/golang-evdev"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newRepeatingKeyboard() (*KeyboardTranslator, *fakeClock, chan InputMessage) {
+	output := make(chan InputMessage, 10)
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	translator := NewKeyboardTranslator(NewMergedKeyboard(output, false), nil, nil, 0, evdev.InputDevice{})
+	translator.Repeat = NewKeyRepeater(300*time.Millisecond, 50*time.Millisecond, clock)
+	return translator, clock, output
+}
+
+// Advances the clock and returns the reports of the repeats due
+func tickAfter(translator *KeyboardTranslator, clock *fakeClock, output chan InputMessage, d time.Duration) [][]byte {
+	clock.Advance(d)
+	translator.Tick()
+	return drain(output)
+}
+
+func TestSoftwareRepeatTiming(t *testing.T) {
+	translator, clock, output := newRepeatingKeyboard()
+	translator.Event(keyEvent(evdev.KEY_LEFTSHIFT, 1))
+	translator.Event(keyEvent(evdev.KEY_A, 1))
+	drain(output)
+
+	if reports := tickAfter(translator, clock, output, 299*time.Millisecond); len(reports) != 0 {
+		t.Fatalf("repeated before the delay: %v", reports)
+	}
+	// Released and pressed again, with the modifier still held
+	expected := [][]byte{{LEFT_SHIFT, 0, 0, 0, 0, 0, 0, 0}, {LEFT_SHIFT, 0, 4, 0, 0, 0, 0, 0}}
+	reports := tickAfter(translator, clock, output, time.Millisecond)
+	if len(reports) != 2 || !bytes.Equal(reports[0], expected[0]) || !bytes.Equal(reports[1], expected[1]) {
+		t.Fatalf("expected %v after the delay, got %v", expected, reports)
+	}
+	if reports := tickAfter(translator, clock, output, 49*time.Millisecond); len(reports) != 0 {
+		t.Fatalf("repeated before the period: %v", reports)
+	}
+	if reports := tickAfter(translator, clock, output, time.Millisecond); len(reports) != 2 {
+		t.Fatalf("expected a repeat after the period, got %v", reports)
+	}
+	// Kernel autorepeat events don't restart the delay
+	translator.Event(keyEvent(evdev.KEY_A, 2))
+	drain(output)
+	if reports := tickAfter(translator, clock, output, 50*time.Millisecond); len(reports) != 2 {
+		t.Fatalf("expected a repeat after kernel autorepeat, got %v", reports)
+	}
+}
+
+func TestSoftwareRepeatModifiers(t *testing.T) {
+	translator, clock, output := newRepeatingKeyboard()
+	translator.Event(keyEvent(evdev.KEY_LEFTCTRL, 1))
+	translator.Event(keyEvent(evdev.KEY_RIGHTALT, 1))
+	drain(output)
+	if reports := tickAfter(translator, clock, output, time.Second); len(reports) != 0 {
+		t.Fatalf("modifiers repeated: %v", reports)
+	}
+}
+
+func TestSoftwareRepeatStops(t *testing.T) {
+	tests := []struct {
+		name  string
+		event *evdev.InputEvent
+	}{
+		{"release", keyEvent(evdev.KEY_A, 0)},
+		{"other key pressed", keyEvent(evdev.KEY_LEFTSHIFT, 1)},
+		{"other key released", keyEvent(evdev.KEY_B, 0)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			translator, clock, output := newRepeatingKeyboard()
+			translator.Event(keyEvent(evdev.KEY_B, 1))
+			translator.Event(keyEvent(evdev.KEY_A, 1))
+			if reports := tickAfter(translator, clock, output, 300*time.Millisecond); len(reports) != 4 {
+				t.Fatalf("expected presses and a repeat, got %v", reports)
+			}
+			translator.Event(test.event)
+			drain(output)
+			if reports := tickAfter(translator, clock, output, time.Second); len(reports) != 0 {
+				t.Fatalf("repeated after %s: %v", test.name, reports)
+			}
+		})
+	}
+}
+
+func TestSoftwareRepeatNewKey(t *testing.T) {
+	translator, clock, output := newRepeatingKeyboard()
+	translator.Event(keyEvent(evdev.KEY_A, 1))
+	clock.Advance(200 * time.Millisecond)
+	translator.Event(keyEvent(evdev.KEY_B, 1))
+	drain(output)
+	// The delay starts over for the new key, which is the one repeated
+	if reports := tickAfter(translator, clock, output, 299*time.Millisecond); len(reports) != 0 {
+		t.Fatalf("repeated before the delay of the new key: %v", reports)
+	}
+	reports := tickAfter(translator, clock, output, time.Millisecond)
+	if len(reports) != 2 || !bytes.Equal(reports[0], []byte{0, 0, 4, 0, 0, 0, 0, 0}) || !bytes.Equal(reports[1], []byte{0, 0, 4, 5, 0, 0, 0, 0}) {
+		t.Fatalf("expected the new key to repeat, got %v", reports)
+	}
+}
+
+func TestSoftwareRepeatSharedKey(t *testing.T) {
+	translator, clock, output := newRepeatingKeyboard()
+	other := NewKeyboardTranslator(translator.Keyboard, nil, nil, 0, evdev.InputDevice{})
+	other.Event(keyEvent(evdev.KEY_A, 1))
+	translator.Event(keyEvent(evdev.KEY_LEFTSHIFT, 1))
+	translator.Event(keyEvent(evdev.KEY_A, 1))
+	drain(output)
+
+	// The other keyboard holding the key doesn't stop the repeat
+	expected := [][]byte{{LEFT_SHIFT, 0, 0, 0, 0, 0, 0, 0}, {LEFT_SHIFT, 0, 4, 0, 0, 0, 0, 0}}
+	reports := tickAfter(translator, clock, output, 300*time.Millisecond)
+	if len(reports) != 2 || !bytes.Equal(reports[0], expected[0]) || !bytes.Equal(reports[1], expected[1]) {
+		t.Fatalf("expected %v, got %v", expected, reports)
+	}
+
+	// The key stays held by the other keyboard after the repeat
+	translator.Event(keyEvent(evdev.KEY_A, 0))
+	translator.Event(keyEvent(evdev.KEY_LEFTSHIFT, 0))
+	reports = drain(output)
+	if len(reports) != 2 || !bytes.Equal(reports[1], []byte{0, 0, 4, 0, 0, 0, 0, 0}) {
+		t.Fatalf("expected the key to stay held, got %v", reports)
+	}
+}
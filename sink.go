@@ -0,0 +1,373 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OUTPUT_LOCAL = "local"
+	OUTPUT_NET   = "net"
+)
+
+// HidWriter writes a HID report (including any report ID) to the host
+type HidWriter interface {
+	WriteReport(report []byte) error
+}
+
+// ReportSink is a HidWriter for a gadget file or a receiver
+type ReportSink interface {
+	HidWriter
+	// Reopen is called after a failed write before retrying
+	Reopen() error
+	Close() error
+}
+
+// Writes each report with a single write, eg. to a bytes.Buffer
+type writer struct {
+	w io.Writer
+}
+
+func NewHidWriter(w io.Writer) HidWriter {
+	return writer{w: w}
+}
+
+func (w writer) WriteReport(report []byte) error {
+	_, err := w.w.Write(report)
+	return err
+}
+
+// Writes reports to a local HID gadget file
+type fileSink struct {
+	path string
+	file *os.File
+}
+
+func NewFileSink(path string) (ReportSink, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{path: path, file: file}, nil
+}
+
+func (s *fileSink) WriteReport(report []byte) error {
+	return NewHidWriter(s.file).WriteReport(report)
+}
+
+func (s *fileSink) Reopen() error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+// Returns the number of a gadget node, eg. 1 for /dev/hidg1
+func gadgetNode(path string) (uint8, error) {
+	node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "hidg"))
+	if err != nil || node < 0 || node > 255 {
+		return 0, fmt.Errorf("not a HID gadget node: %s", path)
+	}
+	return uint8(node), nil
+}
+
+// Sends reports over TCP or UDP to a receiver (see RunReceiver). Each
+// report is framed as the gadget node number, a 16-bit big endian length
+// and the report.
+type netSink struct {
+	network string
+	addr    string
+	node    uint8
+	conn    net.Conn
+}
+
+func NewNetSink(network string, addr string, path string) (ReportSink, error) {
+	node, err := gadgetNode(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &netSink{network: network, addr: addr, node: node}
+	if err := s.Reopen(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *netSink) WriteReport(report []byte) error {
+	frame := make([]byte, 3, 3+len(report))
+	frame[0] = s.node
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(report)))
+	frame = append(frame, report...)
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err := s.conn.Write(frame)
+	return err
+}
+
+func (s *netSink) Reopen() error {
+	conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *netSink) Close() error {
+	return s.conn.Close()
+}
+
+// Opens the sink for an output as configured by OutputMode
+func (out HidOutput) OpenSink() (ReportSink, error) {
+	if out.RemoteAddr != "" {
+		return NewNetSink(out.RemoteNetwork, out.RemoteAddr, out.Path)
+	}
+	return NewFileSink(out.Path)
+}
+
+// Returns the networks allowed to send reports to the receiver, given as
+// IP addresses or CIDR networks. Only loopback is allowed by default.
+func ParseReceiveAllow(entries []string) ([]*net.IPNet, error) {
+	if len(entries) == 0 {
+		entries = []string{"127.0.0.0/8", "::1/128"}
+	}
+	allowed := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address in receive-allow: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			allowed = append(allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network in receive-allow: %s", entry)
+		}
+		allowed = append(allowed, network)
+	}
+	return allowed, nil
+}
+
+// Writes framed reports from a sender to the local gadget files
+type receiver struct {
+	allowed []*net.IPNet
+
+	mu       sync.Mutex
+	files    map[uint8]*os.File
+	conns    map[net.Conn]bool
+	rejected map[string]bool
+}
+
+func newReceiver(allowed []*net.IPNet) *receiver {
+	return &receiver{
+		allowed:  allowed,
+		files:    make(map[uint8]*os.File, 0),
+		conns:    make(map[net.Conn]bool, 0),
+		rejected: make(map[string]bool, 0),
+	}
+}
+
+// Returns true if the sender is in receive-allow, logging rejected senders
+// once
+func (r *receiver) allows(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	for _, network := range r.allowed {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.rejected[ip.String()] {
+		log.Warnf("Rejecting reports from %s, not in receive-allow", addr)
+		r.rejected[ip.String()] = true
+	}
+	return false
+}
+
+func (r *receiver) write(node uint8, report []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, ok := r.files[node]
+	if !ok {
+		var err error
+		path := "/dev/hidg" + strconv.Itoa(int(node))
+		file, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Warnf("Error opening %s: %s", path, err.Error())
+			return
+		}
+		r.files[node] = file
+	}
+	if _, err := file.Write(report); err != nil {
+		log.Warnf("Error writing to /dev/hidg%d: %s", node, err.Error())
+		file.Close()
+		delete(r.files, node)
+	}
+}
+
+func (r *receiver) setConn(conn net.Conn, open bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if open {
+		r.conns[conn] = true
+	} else {
+		delete(r.conns, conn)
+	}
+}
+
+// Closes the connections and gadget files when shutting down
+func (r *receiver) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	for node, file := range r.files {
+		file.Close()
+		delete(r.files, node)
+	}
+}
+
+func (r *receiver) handleStream(conn net.Conn) {
+	defer r.setConn(conn, false)
+	defer conn.Close()
+	log.Infof("Receiving reports from %s", conn.RemoteAddr())
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 3)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Warnf("Error reading from %s: %s", conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+		report := make([]byte, binary.BigEndian.Uint16(header[1:]))
+		if _, err := io.ReadFull(reader, report); err != nil {
+			log.Warnf("Error reading from %s: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+		r.write(header[0], report)
+	}
+}
+
+// RunReceiver sets up the USB gadget if configured and writes the reports
+// received on addr (from a proxy with OutputMode net) to the gadget files
+// until the context is done. Only senders in ReceiveAllow are accepted, as
+// anything received is typed on the host. The sender uses a connection per
+// gadget node, keeping reports in order.
+func RunReceiver(ctx context.Context, config Config, network string, addr string) error {
+	config, err := applyBootProtocol(config)
+	if err != nil {
+		return err
+	}
+	allowed, err := ParseReceiveAllow(config.ReceiveAllow)
+	if err != nil {
+		return err
+	}
+	if config.SetupHid {
+		if err := config.CheckGadget(); err != nil {
+			return err
+		}
+		SetupUSBGadget(config)
+		defer TeardownUSBGadget()
+	}
+	r := newReceiver(allowed)
+	defer r.close()
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	if network == "udp" {
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+		log.Infof("Receiving reports on udp://%s", addr)
+		packet := make([]byte, 1024)
+		for {
+			n, from, err := conn.ReadFrom(packet)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if !r.allows(from) {
+				continue
+			}
+			if n < 3 || int(binary.BigEndian.Uint16(packet[1:]))+3 != n {
+				log.Warnf("Ignoring malformed report packet of %d bytes", n)
+				continue
+			}
+			r.write(packet[0], append([]byte{}, packet[3:n]...))
+		}
+	}
+
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	log.Infof("Receiving reports on %s://%s", network, addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !r.allows(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		r.setConn(conn, true)
+		go r.handleStream(conn)
+	}
+}
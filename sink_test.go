@@ -0,0 +1,194 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"bytes"
+	"context"
+	evdev "github.com/gvalkov/golang-evdev"
+	"net"
+	"testing"
+	"time"
+)
+
+// Writes the reports queued on reports with WriteReports and returns the
+// bytes written
+func writeThrough(t *testing.T, out HidOutput, reports chan InputMessage) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	ctx, cancel := context.WithCancel(context.Background())
+	input := make(chan InputMessage)
+	done := make(chan error)
+	go func() {
+		done <- WriteReports(ctx, out, NewHidWriter(&buf), input)
+	}()
+	for len(reports) > 0 {
+		input <- <-reports
+	}
+	// The last report is written before the context is checked again
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("WriteReports: %s", err.Error())
+	}
+	return buf.Bytes()
+}
+
+func relEvent(code uint16, value int32) *evdev.InputEvent {
+	return &evdev.InputEvent{Type: evdev.EV_REL, Code: code, Value: value}
+}
+
+func TestKeyboardReportsWritten(t *testing.T) {
+	tests := []struct {
+		name     string
+		reportId uint8
+		nkro     bool
+		events   []*evdev.InputEvent
+		expected []byte
+	}{
+		{
+			name:   "modifier and key",
+			events: []*evdev.InputEvent{keyEvent(evdev.KEY_LEFTSHIFT, 1), keyEvent(evdev.KEY_A, 1), keyEvent(evdev.KEY_A, 0), keyEvent(evdev.KEY_LEFTSHIFT, 0)},
+			expected: []byte{
+				LEFT_SHIFT, 0, 0, 0, 0, 0, 0, 0,
+				LEFT_SHIFT, 0, 4, 0, 0, 0, 0, 0,
+				LEFT_SHIFT, 0, 0, 0, 0, 0, 0, 0,
+				0, 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			name:   "right modifiers",
+			events: []*evdev.InputEvent{keyEvent(evdev.KEY_RIGHTCTRL, 1), keyEvent(evdev.KEY_RIGHTALT, 1), keyEvent(evdev.KEY_RIGHTCTRL, 0)},
+			expected: []byte{
+				RIGHT_CONTROL, 0, 0, 0, 0, 0, 0, 0,
+				RIGHT_CONTROL | RIGHT_ALT, 0, 0, 0, 0, 0, 0, 0,
+				RIGHT_ALT, 0, 0, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			name:     "composite report ID",
+			reportId: KEYBOARD_REPORT_ID,
+			events:   []*evdev.InputEvent{keyEvent(evdev.KEY_LEFTCTRL, 1), keyEvent(evdev.KEY_B, 1)},
+			expected: []byte{
+				KEYBOARD_REPORT_ID, LEFT_CONTROL, 0, 0, 0, 0, 0, 0, 0,
+				KEYBOARD_REPORT_ID, LEFT_CONTROL, 0, 5, 0, 0, 0, 0, 0,
+			},
+		},
+		{
+			name:     "nkro",
+			nkro:     true,
+			events:   []*evdev.InputEvent{keyEvent(evdev.KEY_LEFTMETA, 1), keyEvent(evdev.KEY_A, 1)},
+			expected: append(append([]byte{LEFT_META}, make([]byte, NKRO_REPORT_LENGTH-1)...), append([]byte{LEFT_META, 0x10}, make([]byte, NKRO_REPORT_LENGTH-2)...)...),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reports := make(chan InputMessage, 10)
+			translator := NewKeyboardTranslator(NewMergedKeyboard(reports, test.nkro), nil, nil, 0, evdev.InputDevice{})
+			for _, event := range test.events {
+				translator.Event(event)
+			}
+			out := HidOutput{Name: "keyboard", Path: "/dev/hidg0", ReportId: test.reportId, Reports: &Counter{}, Errors: &Counter{}}
+			if written := writeThrough(t, out, reports); !bytes.Equal(written, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, written)
+			}
+		})
+	}
+}
+
+func TestMouseReportsWritten(t *testing.T) {
+	tests := []struct {
+		name     string
+		hires    bool
+		events   []*evdev.InputEvent
+		expected []byte
+	}{
+		{
+			name:     "relative motion",
+			events:   []*evdev.InputEvent{relEvent(evdev.REL_X, 5), relEvent(evdev.REL_Y, -3)},
+			expected: []byte{0, 5, 0, 0, 0, 0, 0xfd, 0},
+		},
+		{
+			name:     "clamped motion",
+			events:   []*evdev.InputEvent{relEvent(evdev.REL_X, 300), relEvent(evdev.REL_Y, -300)},
+			expected: []byte{0, 0x7f, 0, 0, 0, 0, 0x81, 0},
+		},
+		{
+			name:     "button held while moving",
+			events:   []*evdev.InputEvent{keyEvent(evdev.BTN_LEFT, 1), relEvent(evdev.REL_X, -1), keyEvent(evdev.BTN_LEFT, 0)},
+			expected: []byte{BUTTON_LEFT, 0, 0, 0, BUTTON_LEFT, 0xff, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:     "hires pan byte",
+			hires:    true,
+			events:   []*evdev.InputEvent{relEvent(evdev.REL_X, 2)},
+			expected: []byte{0, 2, 0, 0, 0},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reports := make(chan InputMessage, 10)
+			translator := NewMouseTranslator(reports, test.hires, NewMouseMotion(DefaultConfig()), MouseButtons, 0, evdev.InputDevice{})
+			for _, event := range test.events {
+				translator.Event(event)
+			}
+			out := HidOutput{Name: "mouse", Path: "/dev/hidg1", Relative: true, Reports: &Counter{}, Errors: &Counter{}}
+			if written := writeThrough(t, out, reports); !bytes.Equal(written, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, written)
+			}
+		})
+	}
+}
+
+func TestReceiveAllow(t *testing.T) {
+	tests := []struct {
+		entries  []string
+		addr     net.Addr
+		expected bool
+	}{
+		{nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, true},
+		{nil, &net.UDPAddr{IP: net.ParseIP("::1")}, true},
+		{nil, &net.TCPAddr{IP: net.ParseIP("192.168.1.20")}, false},
+		{[]string{"192.168.1.20"}, &net.TCPAddr{IP: net.ParseIP("192.168.1.20")}, true},
+		{[]string{"192.168.1.20"}, &net.TCPAddr{IP: net.ParseIP("192.168.1.21")}, false},
+		{[]string{"192.168.1.20"}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, false},
+		{[]string{"10.0.0.0/8"}, &net.UDPAddr{IP: net.ParseIP("10.1.2.3")}, true},
+		{[]string{"fd00::/8"}, &net.TCPAddr{IP: net.ParseIP("fd00::1")}, true},
+	}
+	for _, test := range tests {
+		allowed, err := ParseReceiveAllow(test.entries)
+		if err != nil {
+			t.Fatalf("%v: %s", test.entries, err.Error())
+		}
+		if allows := newReceiver(allowed).allows(test.addr); allows != test.expected {
+			t.Errorf("%v allowing %s: expected %t, got %t", test.entries, test.addr, test.expected, allows)
+		}
+	}
+	for _, entry := range []string{"gadgetpi", "10.0.0.0/33"} {
+		if _, err := ParseReceiveAllow([]string{entry}); err == nil {
+			t.Errorf("expected an error for %s", entry)
+		}
+	}
+}
+
+func TestReceiverShutdown(t *testing.T) {
+	config := DefaultConfig()
+	config.SetupHid = false
+	for _, network := range []string{"tcp", "udp"} {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- RunReceiver(ctx, config, network, "127.0.0.1:0")
+		}()
+		cancel()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%s receiver: %s", network, err.Error())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s receiver didn't stop", network)
+		}
+	}
+}
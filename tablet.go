@@ -0,0 +1,183 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	evdev "github.com/gvalkov/golang-evdev"
+	"github.com/loov/hrtime"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const TABLET_MAX = 32767
+
+// Absolute pointer report: 3 buttons, 16-bit X and Y (0-32767)
+var TabletReportDescriptor = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xa1, 0x01, // Collection (Application)
+	0x09, 0x01, //   Usage (Pointer)
+	0xa1, 0x00, //   Collection (Physical)
+	0x05, 0x09, //     Usage Page (Button)
+	0x19, 0x01, //     Usage Minimum (1)
+	0x29, 0x03, //     Usage Maximum (3)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x95, 0x03, //     Report Count (3)
+	0x75, 0x01, //     Report Size (1)
+	0x81, 0x02, //     Input (Data, Variable, Absolute)
+	0x95, 0x01, //     Report Count (1)
+	0x75, 0x05, //     Report Size (5)
+	0x81, 0x01, //     Input (Constant)
+	0x05, 0x01, //     Usage Page (Generic Desktop)
+	0x09, 0x30, //     Usage (X)
+	0x09, 0x31, //     Usage (Y)
+	0x16, 0x00, 0x00, //     Logical Minimum (0)
+	0x26, 0xff, 0x7f, //     Logical Maximum (32767)
+	0x75, 0x10, //     Report Size (16)
+	0x95, 0x02, //     Report Count (2)
+	0x81, 0x02, //     Input (Data, Variable, Absolute)
+	0xc0, //   End Collection
+	0xc0, // End Collection
+}
+
+// Evdev button codes of tablets and touch devices to report button bits
+var TabletButtons = map[uint16]uint8{
+	272: BUTTON_LEFT,   // BTN_LEFT
+	273: BUTTON_RIGHT,  // BTN_RIGHT
+	274: BUTTON_MIDDLE, // BTN_MIDDLE
+	330: BUTTON_LEFT,   // BTN_TOUCH
+	331: BUTTON_RIGHT,  // BTN_STYLUS
+	332: BUTTON_MIDDLE, // BTN_STYLUS2
+}
+
+// Corresponds to the input_absinfo struct
+type AbsInfo struct {
+	Value      int32
+	Minimum    int32
+	Maximum    int32
+	Fuzz       int32
+	Flat       int32
+	Resolution int32
+}
+
+// Reads the range of an absolute axis with EVIOCGABS
+func GetAbsInfo(dev evdev.InputDevice, axis int) (AbsInfo, error) {
+	var info AbsInfo
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.File.Fd(), uintptr(evdev.EVIOCGABS(axis)), uintptr(unsafe.Pointer(&info)))
+	if errno != 0 {
+		return info, errno
+	}
+	return info, nil
+}
+
+// Scales an axis value from the device range to 0-TABLET_MAX
+func (a AbsInfo) Scale(value int32) uint16 {
+	if a.Maximum <= a.Minimum {
+		return 0
+	}
+	if value < a.Minimum {
+		value = a.Minimum
+	}
+	if value > a.Maximum {
+		value = a.Maximum
+	}
+	return uint16(int64(value-a.Minimum) * TABLET_MAX / int64(a.Maximum-a.Minimum))
+}
+
+func TabletReport(buttons uint8, x uint16, y uint16) []uint8 {
+	return []uint8{buttons, uint8(x & 0xff), uint8(x >> 8), uint8(y & 0xff), uint8(y >> 8)}
+}
+
+// Returns true for devices reporting an absolute X/Y position
+func isTablet(dev evdev.InputDevice) bool {
+	return hasCapability(dev, evdev.EV_ABS, evdev.ABS_X) && hasCapability(dev, evdev.EV_ABS, evdev.ABS_Y)
+}
+
+func HandleTablet(ctx context.Context, output chan<- error, input chan<- InputMessage, grab bool, dev evdev.InputDevice) error {
+	defer dev.File.Close()
+	if grab && GrabDevice(dev) {
+		defer dev.Release()
+	}
+
+	log.Infof("Reading tablet-like device: %s (%s)", dev.Name, dev.Fn)
+	syscall.SetNonblock(int(dev.File.Fd()), true)
+
+	absX, err := GetAbsInfo(dev, evdev.ABS_X)
+	if err == nil {
+		var absY AbsInfo
+		absY, err = GetAbsInfo(dev, evdev.ABS_Y)
+		if err == nil {
+			log.Debugf("Tablet %s axis ranges: X %d-%d, Y %d-%d", dev.Name, absX.Minimum, absX.Maximum, absY.Minimum, absY.Maximum)
+			err = handleTabletEvents(ctx, input, absX, absY, dev)
+		}
+	}
+	if err != nil {
+		log.Errorf("Error reading from %s (%s): %s", dev.Name, dev.Fn, err.Error())
+		output <- err
+		return err
+	}
+	log.Infof("Stopping processing tablet input from: %s (%s)", dev.Name, dev.Fn)
+	output <- nil
+	return nil
+}
+
+// Tracks the position and buttons, sending a report on every SYN_REPORT
+// that changed them.
+func handleTabletEvents(ctx context.Context, input chan<- InputMessage, absX AbsInfo, absY AbsInfo, dev evdev.InputDevice) error {
+	var buttons uint8 = 0x0
+	x, y := absX.Scale(absX.Value), absY.Scale(absY.Value)
+	changed := false
+	defer func() {
+		if buttons != 0 {
+			log.Infof("Releasing buttons held on %s (%s)", dev.Name, dev.Fn)
+			input <- InputMessage{Timestamp: hrtime.Now(), Message: TabletReport(0, x, y)}
+		}
+	}()
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		err := dev.File.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		if err != nil {
+			return err
+		}
+
+		event, err := dev.ReadOne()
+		if err != nil && strings.Contains(err.Error(), "i/o timeout") {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		log.Debugf("Tablet input event: type=%d, code=%d, value=%d", event.Type, event.Code, event.Value)
+		switch {
+		case event.Type == evdev.EV_KEY:
+			if bit, ok := TabletButtons[event.Code]; ok {
+				buttons = SetButton(buttons, bit, event.Value > 0)
+				changed = true
+			}
+		case event.Type == evdev.EV_ABS && event.Code == evdev.ABS_X:
+			x = absX.Scale(event.Value)
+			changed = true
+		case event.Type == evdev.EV_ABS && event.Code == evdev.ABS_Y:
+			y = absY.Scale(event.Value)
+			changed = true
+		case event.Type == evdev.EV_SYN && event.Code == evdev.SYN_REPORT && changed:
+			report := TabletReport(buttons, x, y)
+			input <- InputMessage{
+				Timestamp: hrtime.Now(),
+				Message:   report,
+			}
+			LogEvent(dev, event, report)
+			changed = false
+		}
+	}
+}
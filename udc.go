@@ -0,0 +1,138 @@
+package hidproxy
+
+// Go implementation of Bluetooth to USB HID proxy
+// Author: Taneli Leppä <rosmo@rosmo.fi>
+// Licensed under Apache License 2.0
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const UDC_CONFIGURED = "configured"
+
+// UdcMonitor tracks the state of the USB device controller, which is
+// "suspended" (or not attached) while the host is asleep.
+type UdcMonitor struct {
+	mu      sync.Mutex
+	state   string
+	resumed chan struct{}
+}
+
+func NewUdcMonitor() *UdcMonitor {
+	return &UdcMonitor{
+		state:   UDC_CONFIGURED,
+		resumed: make(chan struct{}),
+	}
+}
+
+// WaitForUdc waits for a USB device controller to appear, as the UDC driver
+// may still be loading when the proxy starts at boot. With an empty name
+// the only UDC is used.
+func WaitForUdc(name string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		matches, err := filepath.Glob("/sys/class/udc/*")
+		if err != nil {
+			return "", fmt.Errorf("failed to list UDCs: %w", err)
+		}
+		names := make([]string, 0, len(matches))
+		for _, match := range matches {
+			names = append(names, filepath.Base(match))
+		}
+		if name != "" {
+			for _, udc := range names {
+				if udc == name {
+					return name, nil
+				}
+			}
+		} else if len(names) == 1 {
+			return names[0], nil
+		} else if len(names) > 1 {
+			return "", fmt.Errorf("several UDCs found (%s), select one with udc-name", strings.Join(names, ", "))
+		}
+		if !time.Now().Before(deadline) {
+			if name != "" {
+				return "", fmt.Errorf("UDC %s didn't appear within %s", name, timeout)
+			}
+			return "", fmt.Errorf("no UDC appeared within %s, is the dwc2 module loaded?", timeout)
+		}
+		if !logged {
+			log.Infof("Waiting up to %s for a UDC to appear...", timeout)
+			logged = true
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// Returns the name of the UDC the gadget is bound to
+func udcName() string {
+	content, err := ioutil.ReadFile("/sys/kernel/config/usb_gadget/piproxy/UDC")
+	if err == nil && strings.TrimSpace(string(content)) != "" {
+		return strings.TrimSpace(string(content))
+	}
+	matches, err := filepath.Glob("/sys/class/udc/*")
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+	return filepath.Base(matches[0])
+}
+
+func (u *UdcMonitor) State() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.state
+}
+
+// Returns true when the host has configured the gadget and reports can be
+// written. An unknown state counts as configured.
+func (u *UdcMonitor) Configured() bool {
+	return u.State() == UDC_CONFIGURED
+}
+
+// Returns a channel that is closed when the host next resumes
+func (u *UdcMonitor) Resumed() <-chan struct{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.resumed
+}
+
+func (u *UdcMonitor) setState(state string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if state == u.state {
+		return
+	}
+	log.Infof("USB device controller state changed: %s -> %s", u.state, state)
+	if state == UDC_CONFIGURED {
+		close(u.resumed)
+		u.resumed = make(chan struct{})
+	}
+	u.state = state
+}
+
+// Polls the UDC state file until the context is cancelled
+func (u *UdcMonitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if name := udcName(); name != "" {
+			content, err := ioutil.ReadFile(filepath.Join("/sys/class/udc", name, "state"))
+			if err == nil {
+				u.setState(strings.TrimSpace(string(content)))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}